@@ -3,7 +3,14 @@ package goal
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
 )
 
 // Roler is usually assigned to User class, which define which
@@ -22,10 +29,18 @@ type PermitWriter interface {
 	PermitWrite() []string
 }
 
-// Permission makes it easier to implement access control
+// PermitACLChanger allows authenticated user to change the access
+// control list of the record
+type PermitACLChanger interface {
+	PermitChangeACL() []string
+}
+
+// Permission makes it easier to implement access control. Admin
+// lists the roles allowed to change the roles of the record
 type Permission struct {
 	Read  string
 	Write string
+	Admin string
 }
 
 // PermitRead conforms to PermitReader interface
@@ -57,55 +72,256 @@ func (p *Permission) PermitWrite() []string {
 	return nil
 }
 
+// PermitChangeACL conforms to PermitACLChanger interface
+func (p *Permission) PermitChangeACL() []string {
+	if p.Admin != "" {
+		var roles []string
+		err := json.Unmarshal([]byte(p.Admin), &roles)
+		if err != nil {
+			return nil
+		}
+
+		return roles
+	}
+
+	return nil
+}
+
+// Action is an operation performed on a resource
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionRead   Action = "read"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	ActionQuery  Action = "query"
+)
+
+// PermitCreator allows authenticated user to create the record. It is
+// called on an empty record, before the request body is decoded
+type PermitCreator interface {
+	PermitCreate() []string
+}
+
+// PermitUpdater allows authenticated user to update the record.
+// PermitWriter is used if a record does not implement it
+type PermitUpdater interface {
+	PermitUpdate() []string
+}
+
+// PermitDeleter allows authenticated user to delete the record.
+// PermitWriter is used if a record does not implement it
+type PermitDeleter interface {
+	PermitDelete() []string
+}
+
+var ErrUnauthorized = errors.New("unauthorized access")
+
 // CanPerform check if a roler can access a resource (read/write)
-// If read is false, then it will check for write permission
+// If read is false, then it will check for update permission
 // It will return error if the check is failed
 func (g *Goal) CanPerform(resource interface{}, request *http.Request, read bool) error {
-	unauthorized := errors.New("unauthorized access")
+	if read {
+		return g.CanPerformAction(resource, request, ActionRead)
+	}
+	return g.CanPerformAction(resource, request, ActionUpdate)
+}
 
-	// If a resource does not define PermitRead and PermitWrite method,
-	// we assume it is public.
+// CanPerformAction check if a roler can perform the action on a resource
+// It will return error if the check is failed
+func (g *Goal) CanPerformAction(resource interface{}, request *http.Request, action Action) error {
+	return g.checkRoles(request, permittedRoles(resource, action))
+}
+
+// permittedRoles returns the roles allowed to perform the action on a
+// resource. If a resource does not define Permit* methods, we assume it
+// is public.
+func permittedRoles(resource interface{}, action Action) []string {
 	var roles []string
-	if read {
-		permitReader, ok := resource.(PermitReader)
-		if ok {
+	switch action {
+	case ActionRead, ActionQuery:
+		if permitReader, ok := resource.(PermitReader); ok {
 			roles = permitReader.PermitRead()
 		}
-	} else {
-		permitWriter, ok := resource.(PermitWriter)
-		if ok {
+	case ActionCreate:
+		if permitCreator, ok := resource.(PermitCreator); ok {
+			roles = permitCreator.PermitCreate()
+		}
+	case ActionUpdate:
+		if permitUpdater, ok := resource.(PermitUpdater); ok {
+			roles = permitUpdater.PermitUpdate()
+		} else if permitWriter, ok := resource.(PermitWriter); ok {
 			roles = permitWriter.PermitWrite()
 		}
+	case ActionDelete:
+		if permitDeleter, ok := resource.(PermitDeleter); ok {
+			roles = permitDeleter.PermitDelete()
+		} else if permitWriter, ok := resource.(PermitWriter); ok {
+			roles = permitWriter.PermitWrite()
+		}
+	}
+	return roles
+}
+
+// checkRoles checks if current user has one of the roles, no roles
+// meaning the access is public
+func (g *Goal) checkRoles(request *http.Request, roles []string) error {
+	return g.requestRoles(request).check(roles)
+}
+
+// requestRoles resolves the current user and its roles once, so that
+// the records of a request are checked without loading them again.
+// Live queries check events and replays concurrently
+type requestRoles struct {
+	g        *Goal
+	request  *http.Request
+	mu       sync.Mutex
+	resolved bool
+	roles    []string
+	err      error
+}
+
+// requestRoles returns the roles of the current user, which are only
+// resolved when a check needs them
+func (g *Goal) requestRoles(request *http.Request) *requestRoles {
+	return &requestRoles{g: g, request: request}
+}
+
+// get returns the roles of current user, or the error
+// if there is no current user
+func (r *requestRoles) get() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.resolved {
+		r.resolved = true
+		var user interface{}
+		user, r.err = r.g.getCurrentUser(r.request)
+		if r.err == nil {
+			r.roles = r.g.userRoles(user)
+		}
 	}
+	return r.roles, r.err
+}
 
+// check checks if current user has one of the roles, no roles
+// meaning the access is public
+func (r *requestRoles) check(roles []string) error {
 	if len(roles) == 0 {
 		return nil
 	}
 
 	// Retrieve role from current user
-	user, err := g.getCurrentUser(request)
+	userRoles, err := r.get()
 	if err != nil {
 		return err
 	}
 
-	var roler Roler
-	if user != nil {
-		roler, _ = user.(Roler)
+	if hasRole(userRoles, roles) {
+		return nil
 	}
 
-	// If roles is not defined, then this resource does not allow that action
-	if roler == nil || roles == nil {
-		return unauthorized
-	}
+	return ErrUnauthorized
+}
 
-	// Check if roler has role inside permision
-	for _, change := range roles {
-		for _, role := range roler.Roles() {
+// hasRole reports whether one of the user roles is inside the permitted roles
+func hasRole(userRoles []string, permitted []string) bool {
+	for _, change := range permitted {
+		for _, role := range userRoles {
 			if change == role {
-				return nil
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// userRoles returns all the roles of the user, or nil if there is no user
+func (g *Goal) userRoles(user interface{}) []string {
+	if user == nil {
+		return nil
+	}
+
+	roles, err := g.UserRoles(user)
+	if err != nil {
+		logrus.Error(err)
+	}
+	return roles
+}
+
+// currentRoles returns the roles of the current user, or nil
+// if there is no user
+func (g *Goal) currentRoles(request *http.Request) []string {
+	user, err := g.getCurrentUser(request)
+	if err != nil {
+		return nil
+	}
+	return g.userRoles(user)
+}
+
+// embedsPermission reports whether the model embeds Permission
+func embedsPermission(rType reflect.Type) bool {
+	for rType.Kind() == reflect.Ptr {
+		rType = rType.Elem()
+	}
+	if rType.Kind() != reflect.Struct {
+		return false
+	}
+
+	permission := reflect.TypeOf(Permission{})
+	for i := 0; i < rType.NumField(); i++ {
+		field := rType.Field(i)
+		if field.Anonymous && (field.Type == permission || field.Type == reflect.PtrTo(permission)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readScope returns a scope restricting records of a model embedding
+// Permission to the ones current user can read, so that the database
+// applies the access control. It returns nil for other models
+func (g *Goal) readScope(rType reflect.Type, request *http.Request) func(*gorm.DB) *gorm.DB {
+	if !embedsPermission(rType) {
+		return nil
+	}
+
+	scope := g.db.NewScope(newObjectWithType(rType))
+	field, ok := scope.FieldByName("Read")
+	if !ok {
+		return nil
+	}
+	column := scope.Quote(field.DBName)
+
+	// Records without roles are public
+	clauses := []string{
+		fmt.Sprintf("%s IS NULL", column),
+		fmt.Sprintf("%s = ''", column),
+		fmt.Sprintf("%s = '[]'", column),
+		fmt.Sprintf("%s = 'null'", column),
+	}
+	var args []interface{}
+
+	// Read column is a json array of roles
+	for _, role := range g.currentRoles(request) {
+		quoted, err := json.Marshal(role)
+		if err != nil {
+			continue
+		}
+		clauses = append(clauses, fmt.Sprintf("%s LIKE ? ESCAPE '!'", column))
+		args = append(args, "%"+escapeLike(string(quoted))+"%")
+	}
+
+	query := fmt.Sprintf("(%s)", strings.Join(clauses, " OR "))
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(query, args...)
+	}
+}
 
-	return unauthorized
+// escapeLike escapes LIKE wildcards of value with "!", which unlike
+// backslash has the same meaning for every database
+func escapeLike(value string) string {
+	replacer := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return replacer.Replace(value)
 }
@@ -2,13 +2,22 @@ package goal
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
+
+	"github.com/jinzhu/gorm"
 )
 
+func decodeJSON(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
 // Satisfy Roler interface
 func (user *testuser) Roles() []string {
 	ownRole := fmt.Sprintf("testuser:%v", user.ID)
@@ -80,3 +89,382 @@ func TestCanRead(t *testing.T) {
 		t.Error("Request should be unauthorized because Adphi doesn't have admin role")
 	}
 }
+
+func TestQueryReadScope(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	res := httptest.NewRecorder()
+	var json = []byte(`{"username":"Adphi", "password": "something-secret"}`)
+	req, _ := http.NewRequest("POST", "/auth/register", bytes.NewBuffer(json))
+	g.mux.ServeHTTP(res, req)
+	cookie := res.Header().Get("Set-Cookie")
+
+	var user testuser
+	g.db.Where("username = ?", "Adphi").First(&user)
+	own := fmt.Sprintf(`["admin", "testuser:%v"]`, user.ID)
+
+	for _, read := range []string{"", `["admin"]`, "", `["admin"]`, own, ""} {
+		g.db.Create(&article{Title: "Title", Permission: Permission{Read: read}})
+	}
+
+	query := func(cookie string) ([]article, int64) {
+		path := fmt.Sprint(testServer.URL, "/query/article/", url.QueryEscape(`{"limit": 3, "count": true}`))
+		req, _ := http.NewRequest("GET", path, nil)
+		if cookie != "" {
+			req.Header.Add("Cookie", cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var page struct {
+			Results []article
+			Count   int64
+		}
+		decodeJSON(res.Body, &page)
+		return page.Results, page.Count
+	}
+
+	// Limit is applied to the records anonymous user can read
+	results, count := query("")
+	if len(results) != 3 || count != 3 {
+		t.Error("Error: anonymous query should return 3 public articles. Got: ", len(results), count)
+	}
+
+	results, count = query(cookie)
+	if len(results) != 3 || count != 4 {
+		t.Error("Error: user query should count 4 articles. Got: ", len(results), count)
+	}
+}
+
+func TestQueryRolesResolvedOnce(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	user, cookie := registerUser(t, "Adphi")
+	own := fmt.Sprintf(`["testuser:%v"]`, user.ID)
+	for i := 0; i < 20; i++ {
+		g.db.Create(&article{Title: "Title", Permission: Permission{Read: own}})
+	}
+
+	queries := 0
+	g.db.Callback().Query().After("gorm:query").Register("test:count_queries", func(*gorm.Scope) {
+		queries++
+	})
+
+	res := do("GET", "/query/article/"+url.QueryEscape("{}"), "", cookie)
+	var articles []article
+	decodeJSON(res.Body, &articles)
+	if len(articles) != 20 {
+		t.Fatal("User should read its articles. Got: ", len(articles))
+	}
+
+	// User and roles are not loaded again for each article
+	if queries >= 20 {
+		t.Error("Roles should be resolved once per request. Got queries: ", queries)
+	}
+}
+
+type note struct {
+	ID      uint `gorm:"primary_key"`
+	OwnerID uint
+	Text    string
+}
+
+// draft can only be created by admins, unless it looks public
+type draft struct {
+	ID     uint `gorm:"primary_key"`
+	Public bool
+}
+
+func (d *draft) PermitCreate() []string {
+	if d.Public {
+		return nil
+	}
+	return []string{"admin"}
+}
+
+func TestPermitCreate(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.RegisterModel(&draft{}, AllACL())
+
+	// Permission is checked before the body is decoded
+	if res := do("POST", "/draft", `{"Public": true}`, ""); res.Code != 403 {
+		t.Error("Request body should not grant create permission. Got: ", res.Code)
+	}
+}
+
+// registerUser registers a new user and returns its session cookie
+func registerUser(t *testing.T, username string) (*testuser, string) {
+	res := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"username":"%s", "password": "something-secret"}`, username)
+	req, _ := http.NewRequest("POST", "/auth/register", bytes.NewBufferString(body))
+	g.mux.ServeHTTP(res, req)
+
+	cookie := res.Header().Get("Set-Cookie")
+	if cookie == "" {
+		t.Fatal("No cookies. Header:", res.Header())
+	}
+
+	user := &testuser{}
+	g.db.Where("username = ?", username).First(user)
+	return user, cookie
+}
+
+// do serves a request with the session cookie and returns the recorder
+func do(method string, path string, body string, cookie string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if cookie != "" {
+		req.Header.Add("Cookie", cookie)
+	}
+	g.mux.ServeHTTP(res, req)
+	return res
+}
+
+func TestOwnerPolicy(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.RegisterModel(&note{}, AllACL(), OwnerPolicy("owner_id"))
+
+	owner, ownerCookie := registerUser(t, "owner")
+	other, otherCookie := registerUser(t, "other")
+
+	// Owner is set on creation
+	res := do("POST", "/note", `{"Text": "mine"}`, ownerCookie)
+	var n note
+	decodeJSON(res.Body, &n)
+	if res.Code != 200 || n.OwnerID != owner.ID {
+		t.Fatal("Note should be created for its owner. Got: ", res.Code, n)
+	}
+
+	// Record cannot be created for another user
+	res = do("POST", "/note", fmt.Sprintf(`{"Text": "yours", "OwnerID": %d}`, other.ID), ownerCookie)
+	if res.Code != 403 {
+		t.Error("Note should not be created for another user. Got: ", res.Code)
+	}
+
+	path := fmt.Sprint("/note/", n.ID)
+	if res = do("GET", path, "", ownerCookie); res.Code != 200 {
+		t.Error("Owner should read the note. Got: ", res.Code)
+	}
+	if res = do("GET", path, "", otherCookie); res.Code != 404 {
+		t.Error("Other user should not find the note. Got: ", res.Code)
+	}
+	if res = do("GET", path, "", ""); res.Code != 403 {
+		t.Error("Anonymous user should not read the note. Got: ", res.Code)
+	}
+	if res = do("DELETE", path, "", otherCookie); res.Code != 404 {
+		t.Error("Other user should not delete the note. Got: ", res.Code)
+	}
+
+	// Record cannot be given to another user
+	body := fmt.Sprintf(`{"OwnerID": %d}`, other.ID)
+	if res = do("PUT", path, body, ownerCookie); res.Code != 403 {
+		t.Error("Note should not be given to another user. Got: ", res.Code)
+	}
+
+	query := "/query/note/" + url.QueryEscape(`{}`)
+	var notes []note
+	decodeJSON(do("GET", query, "", otherCookie).Body, &notes)
+	if len(notes) != 0 {
+		t.Error("Other user should not query the note. Got: ", notes)
+	}
+	decodeJSON(do("GET", query, "", ownerCookie).Body, &notes)
+	if len(notes) != 1 {
+		t.Error("Owner should query the note. Got: ", notes)
+	}
+}
+
+func TestClassPermissions(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	user, cookie := registerUser(t, "Adphi")
+
+	err := g.SetClassPermissions(&article{}, ClassPermissions{
+		ActionRead:   {Public: true},
+		ActionCreate: {Roles: []string{"admin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.SetClassPermissions(&testuser{}, ClassPermissions{
+		ActionRead:   {Authenticated: true},
+		ActionDelete: {Users: []string{fmt.Sprint(user.ID)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := do("POST", "/article", `{"Title": "News"}`, cookie); res.Code != 403 {
+		t.Error("Only admin should create articles. Got: ", res.Code)
+	}
+
+	path := fmt.Sprint("/testuser/", user.ID)
+	if res := do("GET", path, "", ""); res.Code != 403 {
+		t.Error("Anonymous user should not read users. Got: ", res.Code)
+	}
+	if res := do("GET", path, "", cookie); res.Code != 200 {
+		t.Error("User should be readable. Got: ", res.Code)
+	}
+	if res := do("PUT", path, `{"Name": "Thomas"}`, cookie); res.Code != 403 {
+		t.Error("Nobody should update users. Got: ", res.Code)
+	}
+	if res := do("DELETE", path, "", cookie); res.Code != 200 {
+		t.Error("User should delete itself. Got: ", res.Code)
+	}
+
+	// ResourceACL is used again after reset
+	g.ResetClassPermissions(&testuser{})
+	permissions, _ := g.ClassPermissions(&testuser{})
+	if !permissions[ActionUpdate].Public {
+		t.Error("ResourceACL should be used after reset. Got: ", permissions)
+	}
+}
+
+func TestClassPermissionsAdmin(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.c.adminRoles = []string{"admin"}
+	g.AddDefaultAdminPaths()
+
+	_, cookie := registerUser(t, "Adphi")
+
+	body := `{"read": {"public": true}, "create": {"authenticated": true}}`
+	if res := do("PUT", "/admin/permissions/article", body, cookie); res.Code != 403 {
+		t.Error("Only admin should change permissions. Got: ", res.Code)
+	}
+
+	// Adphi becomes admin
+	g.c.adminRoles = []string{"testuser:1"}
+	res := do("PUT", "/admin/permissions/article", body, cookie)
+	if res.Code != 200 {
+		t.Fatal("Admin should change permissions. Got: ", res.Code, res.Body.String())
+	}
+
+	permissions, _ := g.ClassPermissions(&article{})
+	if !permissions[ActionCreate].Authenticated || permissions[ActionDelete].Public {
+		t.Error("Permissions should be stored. Got: ", permissions)
+	}
+
+	if res = do("PUT", "/admin/permissions/article", `{"drop": {"public": true}}`, cookie); res.Code != 400 {
+		t.Error("Unknown action should be rejected. Got: ", res.Code)
+	}
+}
+
+func TestClassPermissionsCache(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.cacher = NewMemoryCache()
+	defer func() { g.cacher = nil }()
+
+	permissions, _ := g.ClassPermissions(&article{})
+	if !permissions[ActionCreate].Public {
+		t.Fatal("ResourceACL should be used. Got: ", permissions)
+	}
+
+	// Database is not read again while permissions are cached
+	g.db.Save(&classPermission{Class: g.tableName(&article{}), Permissions: `{"read": {"public": true}}`})
+	if permissions, _ = g.ClassPermissions(&article{}); !permissions[ActionCreate].Public {
+		t.Error("Permissions should be cached. Got: ", permissions)
+	}
+
+	g.SetClassPermissions(&article{}, ClassPermissions{ActionRead: {Authenticated: true}})
+	if permissions, _ = g.ClassPermissions(&article{}); !permissions[ActionRead].Authenticated {
+		t.Error("Set should invalidate the cache. Got: ", permissions)
+	}
+
+	g.ResetClassPermissions(&article{})
+	if permissions, _ = g.ClassPermissions(&article{}); !permissions[ActionCreate].Public {
+		t.Error("Reset should invalidate the cache. Got: ", permissions)
+	}
+}
+
+func TestACL(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	_, ownerCookie := registerUser(t, "owner")
+	_, writerCookie := registerUser(t, "writer")
+
+	art := &article{Title: "News"}
+	art.Permission = Permission{
+		Read:  `["testuser:1", "testuser:2"]`,
+		Write: `["testuser:1", "testuser:2"]`,
+		Admin: `["testuser:1"]`,
+	}
+	g.db.Create(art)
+	path := fmt.Sprint("/article/", art.ID)
+
+	// Ordinary updates do not change the roles
+	body := `{"Title": "Mine", "Read": "[\"testuser:2\"]", "Admin": "[\"testuser:2\"]"}`
+	if res := do("PUT", path, body, writerCookie); res.Code != 200 {
+		t.Fatal("Writer should update the article. Got: ", res.Code, res.Body.String())
+	}
+	updated := &article{}
+	g.db.First(updated, art.ID)
+	if updated.Title != "Mine" || updated.Read != art.Read || updated.Admin != art.Admin {
+		t.Error("Roles should not be updated. Got: ", updated.Permission)
+	}
+
+	if res := do("PUT", path+"/acl", `{"admin": ["testuser:2"]}`, writerCookie); res.Code != 403 {
+		t.Error("Writer should not change roles. Got: ", res.Code)
+	}
+
+	res := do("PUT", path+"/acl", `{"read": ["testuser:1"]}`, ownerCookie)
+	if res.Code != 200 {
+		t.Fatal("Owner should change roles. Got: ", res.Code, res.Body.String())
+	}
+	acl := &ACL{}
+	decodeJSON(res.Body, acl)
+	if !reflect.DeepEqual(acl.Read, []string{"testuser:1"}) || len(acl.Write) != 2 {
+		t.Error("Only read roles should be changed. Got: ", acl)
+	}
+
+	if res = do("GET", path+"/acl", "", writerCookie); res.Code != 403 {
+		t.Error("Writer should not read the article anymore. Got: ", res.Code)
+	}
+}
+
+func TestDefaultACL(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	// Owner write, public read
+	g.SetDefaultACL(&article{}, DefaultACL{OwnerWrite: true, OwnerAdmin: true, Override: []string{"testuser:2"}})
+
+	_, ownerCookie := registerUser(t, "owner")
+	_, editorCookie := registerUser(t, "editor")
+
+	if res := do("POST", "/article", `{"Title": "News"}`, ""); res.Code != 403 {
+		t.Error("Anonymous user should not own an article. Got: ", res.Code)
+	}
+
+	res := do("POST", "/article", `{"Title": "News"}`, ownerCookie)
+	art := &article{}
+	decodeJSON(res.Body, art)
+	if res.Code != 200 || art.Read != "" || art.Write != `["testuser:1"]` || art.Admin != `["testuser:1"]` {
+		t.Fatal("Article should be owned by its creator. Got: ", res.Code, art.Permission)
+	}
+
+	body := `{"Title": "Secret", "Read": "[\"testuser:1\"]"}`
+	if res = do("POST", "/article", body, ownerCookie); res.Code != 403 {
+		t.Error("Owner should not override default roles. Got: ", res.Code)
+	}
+
+	res = do("POST", "/article", body, editorCookie)
+	art = &article{}
+	decodeJSON(res.Body, art)
+	if res.Code != 200 || art.Read != `["testuser:1"]` || art.Write != `["testuser:2"]` {
+		t.Error("Editor should override default roles. Got: ", res.Code, art.Permission)
+	}
+}
@@ -0,0 +1,248 @@
+// acl lets users change the roles of a record embedding Permission,
+// with a dedicated endpoint. Ordinary updates cannot change them:
+// PUT /article/1/acl {"read": ["admin", "ceo"], "write": ["admin"]}
+
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/gorilla/mux"
+)
+
+// ACL is the access control list of a record. Nil roles are
+// left unchanged by updates
+type ACL struct {
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+	Admin []string `json:"admin"`
+}
+
+// DefaultACL defines the roles given to the records of a model created
+// through goal. Empty roles are public, owner roles are the own role of
+// the user creating the record: "testuser:1"
+type DefaultACL struct {
+	Read  []string
+	Write []string
+	Admin []string
+	// OwnerRead, OwnerWrite and OwnerAdmin add the owner role
+	OwnerRead  bool
+	OwnerWrite bool
+	OwnerAdmin bool
+	// Override lists the roles allowed to send the roles of created
+	// records, in addition to administrator roles
+	Override []string
+}
+
+var (
+	ErrNoACL       = errors.New("model has no access control list")
+	ErrACLOverride = errors.New("record roles cannot be set")
+)
+
+// embeddedPermission returns the Permission embedded in resource, or nil
+func embeddedPermission(resource interface{}) *Permission {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	permission := reflect.TypeOf(Permission{})
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		switch field.Type {
+		case permission:
+			return v.Field(i).Addr().Interface().(*Permission)
+		case reflect.PtrTo(permission):
+			if v.Field(i).IsNil() {
+				return nil
+			}
+			return v.Field(i).Interface().(*Permission)
+		}
+	}
+	return nil
+}
+
+// CanChangeACL checks if current user can change the access control list
+// of a resource. Unlike other permissions, a record without roles is not
+// public: only administrators can change it
+func (g *Goal) CanChangeACL(resource interface{}, request *http.Request) error {
+	roles := append([]string{}, g.c.adminRoles...)
+	if changer, ok := resource.(PermitACLChanger); ok {
+		roles = append(roles, changer.PermitChangeACL()...)
+	}
+	if len(roles) == 0 {
+		return ErrUnauthorized
+	}
+	return g.checkRoles(request, roles)
+}
+
+// aclHandler reads or changes the access control list of a record
+func (g *Goal) aclHandler(rType reflect.Type) simpleResponse {
+	return func(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+		id, exists := mux.Vars(request)["id"]
+		if !exists {
+			err := errors.New("id is required")
+			return 400, nil, err
+		}
+
+		resource := newObjectWithType(rType)
+
+		// Restrict to the records user can access
+		policy, err := g.policyScope(rType, request)
+		if err != nil {
+			return 403, nil, err
+		}
+
+		err = g.db.Scopes(scopes(policy)...).Where("id = ?", id).First(resource).Error
+		if err != nil {
+			return errorCode(err), nil, err
+		}
+
+		permission := embeddedPermission(resource)
+		if permission == nil {
+			return 404, nil, ErrNoACL
+		}
+
+		switch request.Method {
+		case http.MethodGet:
+			if err = g.CanPerform(resource, request, true); err != nil {
+				return 403, nil, err
+			}
+		case http.MethodPut:
+			if err = g.CanChangeACL(resource, request); err != nil {
+				return 403, nil, err
+			}
+
+			acl := &ACL{}
+			if err = json.NewDecoder(request.Body).Decode(acl); err != nil {
+				return 400, nil, err
+			}
+
+			scope := g.db.NewScope(resource)
+			values := map[string]interface{}{}
+			for name, roles := range map[string][]string{"Read": acl.Read, "Write": acl.Write, "Admin": acl.Admin} {
+				if roles == nil {
+					continue
+				}
+				data, err := json.Marshal(roles)
+				if err != nil {
+					return 400, nil, err
+				}
+				field, _ := scope.FieldByName(name)
+				values[field.DBName] = string(data)
+			}
+
+			if len(values) > 0 {
+				if err = g.db.Model(resource).Updates(values).Error; err != nil {
+					return 500, nil, err
+				}
+			}
+		default:
+			return 405, nil, http.ErrNotSupported
+		}
+
+		return 200, &ACL{
+			Read:  permission.PermitRead(),
+			Write: permission.PermitWrite(),
+			Admin: permission.PermitChangeACL(),
+		}, nil
+	}
+}
+
+// AddACLPath lets users read and change the access control list of
+// the records of resource on path, which must define an "id" variable
+func (g *Goal) AddACLPath(resource interface{}, path string) {
+	g.mux.HandleFunc(path, func(rw http.ResponseWriter, request *http.Request) {
+		handler := g.aclHandler(reflect.TypeOf(resource))
+
+		// Changing the roles of a record is an update of the record
+		action := ActionRead
+		if request.Method != http.MethodGet {
+			action = ActionUpdate
+		}
+		g.renderJSON(rw, request, g.guard(resource, action, handler, false))
+	})
+}
+
+// AddDefaultACLPath adds the access control list path of a resource
+// embedding Permission. The path is based on struct name
+func (g *Goal) AddDefaultACLPath(resource interface{}) {
+	if !embedsPermission(reflect.TypeOf(resource)) {
+		return
+	}
+	aclPath := fmt.Sprintf("/%s/{id:[a-zA-Z0-9]+}/acl", g.tableName(resource))
+	g.AddACLPath(resource, aclPath)
+}
+
+// SetDefaultACL gives default roles to the records of resource
+// when they are created
+func (g *Goal) SetDefaultACL(resource interface{}, acl DefaultACL) {
+	if g.defaultACLs == nil {
+		g.defaultACLs = map[reflect.Type]DefaultACL{}
+	}
+	g.defaultACLs[reflect.TypeOf(resource)] = acl
+}
+
+// applyDefaultACL sets the default roles of the model on a created
+// resource. Roles sent by the client are kept if it can override them
+func (g *Goal) applyDefaultACL(resource interface{}, request *http.Request) error {
+	acl, ok := g.defaultACLs[reflect.TypeOf(resource)]
+	if !ok {
+		return nil
+	}
+	permission := embeddedPermission(resource)
+	if permission == nil {
+		return nil
+	}
+
+	if *permission != (Permission{}) {
+		roles := append(append([]string{}, g.c.adminRoles...), acl.Override...)
+		if len(roles) == 0 || g.checkRoles(request, roles) != nil {
+			return ErrACLOverride
+		}
+	}
+
+	var owner string
+	if acl.OwnerRead || acl.OwnerWrite || acl.OwnerAdmin {
+		user, err := g.getCurrentUser(request)
+		if err != nil || user == nil {
+			return ErrUnauthorized
+		}
+		owner = g.ownRole(user)
+	}
+
+	defaults := []struct {
+		column *string
+		roles  []string
+		owner  bool
+	}{
+		{&permission.Read, acl.Read, acl.OwnerRead},
+		{&permission.Write, acl.Write, acl.OwnerWrite},
+		{&permission.Admin, acl.Admin, acl.OwnerAdmin},
+	}
+	for _, d := range defaults {
+		if *d.column != "" {
+			continue
+		}
+		roles := d.roles
+		if d.owner {
+			roles = append([]string{owner}, roles...)
+		}
+		if len(roles) == 0 {
+			continue
+		}
+		data, err := json.Marshal(roles)
+		if err != nil {
+			return err
+		}
+		*d.column = string(data)
+	}
+	return nil
+}
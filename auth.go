@@ -23,9 +23,11 @@ func (g *Goal) registerHandler(resource interface{}) http.HandlerFunc {
 
 		if resource, ok := resource.(Registerer); ok {
 			handler = resource.Register
+		} else if g.userType != nil {
+			handler = g.defaultRegister
 		}
 
-		renderJSON(rw, request, handler)
+		g.renderJSON(rw, request, handler)
 	}
 }
 
@@ -35,9 +37,11 @@ func (g *Goal) loginHandler(resource interface{}) http.HandlerFunc {
 
 		if resource, ok := resource.(Loginer); ok {
 			handler = resource.Login
+		} else if g.userType != nil {
+			handler = g.defaultLogin
 		}
 
-		renderJSON(rw, request, handler)
+		g.renderJSON(rw, request, handler)
 	}
 }
 
@@ -47,12 +51,69 @@ func (g *Goal) logoutHandler(resource interface{}) http.HandlerFunc {
 
 		if resource, ok := resource.(Logouter); ok {
 			handler = resource.Logout
+		} else if g.userType != nil {
+			handler = g.HandleLogout
 		}
 
-		renderJSON(rw, request, handler)
+		g.renderJSON(rw, request, handler)
 	}
 }
 
+// defaultRegister registers users with the columns of the user model
+func (g *Goal) defaultRegister(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	user, err := g.RegisterWithPassword(rw, request, g.c.usernameColumn, g.c.passwordColumn)
+	if err == http.ErrNotSupported {
+		return 405, nil, err
+	}
+	if violations, ok := policyViolations(err); ok {
+		return 422, violations, err
+	}
+	if _, ok := err.(*SessionError); ok {
+		return 500, nil, err
+	}
+	if err != nil {
+		return 400, nil, err
+	}
+	return 200, user, nil
+}
+
+// defaultLogin logs users in with the columns of the user model
+func (g *Goal) defaultLogin(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	user, err := g.LoginWithPassword(rw, request, g.c.usernameColumn, g.c.passwordColumn)
+	if err == http.ErrNotSupported {
+		return 405, nil, err
+	}
+	if err == ErrEmailNotVerified {
+		return 403, nil, err
+	}
+	if err == ErrTooManyAttempts {
+		return 429, nil, err
+	}
+	if err == ErrSecondFactorRequired {
+		return 401, user, err
+	}
+	if _, ok := err.(*SessionError); ok {
+		return 500, nil, err
+	}
+	if err != nil {
+		return 401, nil, err
+	}
+	return 200, user, nil
+}
+
+// meHandler returns the current user
+func (g *Goal) meHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	if request.Method != http.MethodGet {
+		return 405, nil, http.ErrNotSupported
+	}
+
+	user, err := g.getCurrentUser(request)
+	if err != nil {
+		return 401, nil, err
+	}
+	return 200, user, nil
+}
+
 // AddRegisterPath let user to register into a system
 func (g *Goal) AddRegisterPath(resource interface{}, path string) {
 	g.mux.Handle(path, g.registerHandler(resource))
@@ -68,10 +129,25 @@ func (g *Goal) AddLogoutPath(resource interface{}, path string) {
 	g.mux.Handle(path, g.logoutHandler(resource))
 }
 
+// AddMePath returns the current user on path
+func (g *Goal) AddMePath(path string) {
+	g.mux.HandleFunc(path, func(rw http.ResponseWriter, request *http.Request) {
+		g.renderJSON(rw, request, g.meHandler)
+	})
+}
+
 // AddDefaultAuthPaths route request to the model which implement
-// authentications
+// authentications. Goal handles them with the columns given to
+// SetUserModel if the model does not
 func (g *Goal) AddDefaultAuthPaths(resource interface{}) {
 	g.mux.Handle("/auth/register", g.registerHandler(resource))
 	g.mux.Handle("/auth/login", g.loginHandler(resource))
 	g.mux.Handle("/auth/logout", g.logoutHandler(resource))
+	g.AddMePath("/auth/me")
+	if g.mailer != nil {
+		g.AddVerificationPaths()
+	}
+	g.AddSessionPaths()
+	g.AddPasswordPath()
+	g.AddTOTPPaths()
 }
@@ -7,7 +7,7 @@ import (
 	"net/http"
 
 	"github.com/jinzhu/gorm"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sirupsen/logrus"
 )
 
 // validateCols columns are valid
@@ -26,7 +26,7 @@ func (g *Goal) validateCols(usernameCol string, passwordCol string, user interfa
 }
 
 // RegisterWithPassword checks if username exists and
-// sets password with bcrypt algorithm
+// sets password hashed with the PasswordHasher
 // Client can provides extra data to be saved into database for user
 func (g *Goal) RegisterWithPassword(
 	w http.ResponseWriter, request *http.Request,
@@ -55,6 +55,10 @@ func (g *Goal) RegisterWithPassword(
 		return nil, errors.New("username or password is not found")
 	}
 
+	if err = g.ValidatePassword(password, username); err != nil {
+		return nil, err
+	}
+
 	err = g.validateCols(usernameCol, passwordCol, user)
 
 	if err != nil {
@@ -83,9 +87,11 @@ func (g *Goal) RegisterWithPassword(
 
 	// Save a new record to db
 	scope.SetColumn(usernameCol, username)
+	if email := values[g.emailColumn()]; email != "" && g.emailColumn() != usernameCol {
+		scope.SetColumn(g.emailColumn(), email)
+	}
 
-	// Hashing the password with the default cost of 10
-	hashedPw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPw, err := g.HashPassword(password)
 	if err != nil {
 		return nil, err
 	}
@@ -95,14 +101,28 @@ func (g *Goal) RegisterWithPassword(
 		return nil, err
 	}
 
+	if g.mailer != nil {
+		if err = g.SendVerificationEmail(user); err != nil {
+			logrus.Errorf("Unable to send verification email: %v", err)
+		}
+	}
+
+	// User will login once its email is verified
+	if g.c.requireVerification {
+		return user, nil
+	}
+
 	// Set current session
-	g.setUserSession(w, request, user)
+	if err = g.setUserSession(w, request, user); err != nil {
+		return nil, &SessionError{Err: err}
+	}
 
 	return user, nil
 }
 
 // LoginWithPassword checks if username and password correct
-// and set user into session
+// and set user into session. If the user enabled TOTP, it returns
+// a *SecondFactorChallenge with ErrSecondFactorRequired instead
 func (g *Goal) LoginWithPassword(
 	w http.ResponseWriter, request *http.Request,
 	usernameCol string, passwordCol string) (interface{}, error) {
@@ -135,20 +155,26 @@ func (g *Goal) LoginWithPassword(
 		return nil, errors.New("username or password is not found")
 	}
 
-	// Search db, if a username is not found, return error
+	if until := g.lockedUntil(username, request); !until.IsZero() {
+		setRetryAfter(w, until)
+		return nil, ErrTooManyAttempts
+	}
+
+	// Search db, an unknown username fails like a wrong password
 	qry := fmt.Sprintf("%s = ?", usernameCol)
 
 	qryDB := g.db.Where(qry, username).First(user)
 	err = qryDB.Error
+	if gorm.IsRecordNotFoundError(err) {
+		// Take as long as a password check
+		g.verifyDummyPassword(password)
+		g.loginFailed(username, request)
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if user == nil {
-		errorMsg := fmt.Sprintf("Username not found: %s", username)
-		return nil, errors.New(errorMsg)
-	}
-
 	// Make sure the password is correct
 	var hashs []string
 	qryDB.Pluck(passwordCol, &hashs)
@@ -160,19 +186,78 @@ func (g *Goal) LoginWithPassword(
 
 	hashed := hashs[0]
 
-	// Comparing the password with the hash
-	err = bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+	// Comparing the password with the hash. A hash which cannot be
+	// verified fails like a wrong password, without telling why
+	valid, err := g.VerifyPassword(password, hashed)
+	if err != nil {
+		logrus.Errorf("Unable to verify password: %v", err)
+	}
+	if err != nil || !valid {
+		g.loginFailed(username, request)
+		return nil, ErrInvalidCredentials
+	}
+	g.loginSucceeded(username, request)
+
+	// Upgrade hashes made with previous algorithms or parameters
+	if g.passwords.hasher.NeedsRehash(hashed) {
+		g.rehashPassword(user, passwordCol, password)
+	}
+
+	if g.c.requireVerification {
+		verified, err := g.IsEmailVerified(user)
+		if err != nil {
+			return nil, err
+		}
+		if !verified {
+			return nil, ErrEmailNotVerified
+		}
+	}
+
+	// The session is set once the second factor is sent
+	challenge, err := g.secondFactorChallenge(user)
 	if err != nil {
 		return nil, err
 	}
+	if challenge != nil {
+		return challenge, ErrSecondFactorRequired
+	}
 
 	// Set current session
-	g.setUserSession(w, request, user)
+	if err = g.setUserSession(w, request, user); err != nil {
+		return nil, &SessionError{Err: err}
+	}
 
 	return user, nil
 }
 
-// HandleLogout let user logout from the system
-func (g *Goal) HandleLogout(w http.ResponseWriter, request *http.Request) {
-	clearUserSession(w, request)
+// HandleLogout let user logout from the system: its server side
+// session is revoked, the session cookie expired and the user removed
+// from cache. It returns the response of a Logouter
+func (g *Goal) HandleLogout(w http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	if session, err := g.currentSession(request); err == nil {
+		if err = g.RevokeSession(session.ID); err != nil {
+			return 500, nil, err
+		}
+		if user, err := g.getUserResource(); err == nil {
+			g.uncacheKey(defaultCacheKey(g.tableName(user), session.UserID))
+		}
+	}
+
+	if err := g.clearUserSession(w, request); err != nil {
+		return 500, nil, err
+	}
+	return 200, nil, nil
+}
+
+// rehashPassword stores the password hashed with current hasher.
+// Errors are only logged, the user can still login with the old hash
+func (g *Goal) rehashPassword(user interface{}, passwordCol string, password string) {
+	hashed, err := g.HashPassword(password)
+	if err != nil {
+		logrus.Errorf("Unable to rehash password: %v", err)
+		return
+	}
+	if err = g.db.Model(user).Update(passwordCol, hashed).Error; err != nil {
+		logrus.Errorf("Unable to rehash password: %v", err)
+	}
 }
@@ -2,10 +2,15 @@ package goal
 
 import (
 	"bytes"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/sessions"
 )
 
 // Setup methods to conform to auth interfaces
@@ -30,8 +35,7 @@ func (user *testuser) Login(w http.ResponseWriter, req *http.Request) (int, inte
 }
 
 func (user *testuser) Logout(w http.ResponseWriter, req *http.Request) (int, interface{}, error) {
-	g.HandleLogout(w, req)
-	return 200, nil, nil
+	return g.HandleLogout(w, req)
 }
 
 func TestAuth(t *testing.T) {
@@ -76,10 +80,12 @@ func TestAuth(t *testing.T) {
 	g.mux.ServeHTTP(recorder, logoutReq)
 
 	// Make sure cookies is cleared after logout
-	hdr = recorder.Header()
-	cookies, ok = hdr["Set-Cookie"]
-	if ok || len(cookies) == 1 {
-		t.Fatal("Cookies should be cleared after logout")
+	res := http.Response{Header: recorder.Header()}
+	if len(res.Cookies()) != 1 || res.Cookies()[0].MaxAge >= 0 {
+		t.Fatal("Cookies should be cleared after logout. Header:", recorder.Header())
+	}
+	if _, err = g.getCurrentUser(logoutReq); err == nil {
+		t.Fatal("User should be logged out")
 	}
 
 	// Test login
@@ -97,3 +103,237 @@ func TestAuth(t *testing.T) {
 	}
 
 }
+
+func TestUserSessions(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	key := JWTKey{ID: "hmac", Method: jwt.SigningMethodHS256, SignKey: []byte("secret"), VerifyKey: []byte("secret")}
+	WithJWT(JWTConfig{Keys: []JWTKey{key}})(g)
+
+	user, cookie := registerUser(t, "Adphi")
+
+	res := do("POST", "/auth/login", `{"username":"Adphi", "password": "something-secret"}`, "")
+	refreshToken := res.Header().Get(RefreshTokenHeader)
+	if res.Code != 200 || refreshToken == "" {
+		t.Fatal("Login should issue a refresh token. Got: ", res.Code, res.Header())
+	}
+
+	// Refresh token is rotated
+	body := `{"refresh_token": "` + refreshToken + `"}`
+	res = do("POST", "/auth/refresh", body, "")
+	tokens := &tokenResponse{}
+	decodeJSON(res.Body, tokens)
+	if res.Code != 200 || tokens.AccessToken == "" || tokens.RefreshToken == refreshToken {
+		t.Fatal("Refresh should issue new tokens. Got: ", res.Code, tokens)
+	}
+	if res = do("POST", "/auth/refresh", body, ""); res.Code != 401 {
+		t.Error("Refresh token should not be used twice. Got: ", res.Code)
+	}
+	if code := doBearer("GET", "/auth/sessions", tokens.AccessToken); code != 200 {
+		t.Error("Refreshed access token should be accepted. Got: ", code)
+	}
+
+	var sessions []UserSession
+	decodeJSON(do("GET", "/auth/sessions", "", cookie).Body, &sessions)
+	if len(sessions) != 2 || !sessions[1].Current {
+		t.Fatal("User should have two sessions. Got: ", sessions)
+	}
+
+	// Revoke the session of the refresh token
+	if res = do("DELETE", "/auth/sessions/"+sessions[0].ID, "", cookie); res.Code != 200 {
+		t.Error("User should revoke its session. Got: ", res.Code)
+	}
+	if code := doBearer("GET", "/auth/sessions", tokens.AccessToken); code != 401 {
+		t.Error("Access token of a revoked session should be rejected. Got: ", code)
+	}
+	body = `{"refresh_token": "` + tokens.RefreshToken + `"}`
+	if res = do("POST", "/auth/refresh", body, ""); res.Code != 401 {
+		t.Error("Refresh token of a revoked session should be rejected. Got: ", res.Code)
+	}
+
+	// Logout revokes the session of the cookie and evicts the cached user
+	cache := NewMemoryCache()
+	g.cacher = cache
+	cache.Set(g.cacheKey(user), user)
+
+	do("POST", "/auth/logout", "", cookie)
+	if exists, _ := cache.Exists(g.cacheKey(user)); exists {
+		t.Error("User should be removed from cache")
+	}
+	if _, err := g.getCurrentUser(requestWithCookie(cookie)); err == nil {
+		t.Error("User should be logged out")
+	}
+	if sessions, _ := g.UserSessions(user); len(sessions) != 0 {
+		t.Error("User should not have active sessions. Got: ", sessions)
+	}
+}
+
+// requestWithCookie returns a request with the session cookie
+func requestWithCookie(cookie string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("Cookie", cookie)
+	return req
+}
+
+// serveWith serves a request with another goal instance
+func serveWith(goal *Goal, method string, path string, body string, cookie string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	if cookie != "" {
+		req.Header.Add("Cookie", cookie)
+	}
+	goal.mux.ServeHTTP(res, req)
+	return res
+}
+
+// account does not implement auth interfaces
+type account struct {
+	ID     uint `gorm:"primary_key"`
+	Email  string
+	Secret string
+}
+
+// setupAccounts creates a goal instance with options, authenticating
+// accounts by email. It returns the goal and a function serving its
+// requests, like serveWith
+func setupAccounts(t *testing.T, options ...Option) (*Goal, func(string, string, string, string) *httptest.ResponseRecorder) {
+	options = append([]Option{
+		WithDBAddress("sqlite3", ":memory:"),
+		WithSessionStore([]byte("something-very-secret")),
+	}, options...)
+	ng, err := NewGoal(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ng.db.AutoMigrate(&account{})
+	ng.SetUserModel(&account{}, UsernameColumn("email"), PasswordColumn("secret"))
+	ng.AddDefaultAuthPaths(&account{})
+
+	serve := func(method string, path string, body string, cookie string) *httptest.ResponseRecorder {
+		return serveWith(ng, method, path, body, cookie)
+	}
+	return ng, serve
+}
+
+func TestDefaultAuthHandlers(t *testing.T) {
+	ng, serve := setupAccounts(t)
+	defer ng.Close()
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	res := serve("POST", "/auth/register", body, "")
+	if res.Code != 200 {
+		t.Fatal("User should be registered. Got: ", res.Code, res.Body.String())
+	}
+	if res = serve("POST", "/auth/register", body, ""); res.Code != 400 {
+		t.Error("User should not be registered twice. Got: ", res.Code)
+	}
+
+	wrong := `{"email": "adphi@example.com", "secret": "wrong"}`
+	if res = serve("POST", "/auth/login", wrong, ""); res.Code != 401 {
+		t.Error("Wrong password should be rejected. Got: ", res.Code)
+	}
+	res = serve("POST", "/auth/login", body, "")
+	cookie := res.Header().Get("Set-Cookie")
+	if res.Code != 200 || cookie == "" {
+		t.Fatal("User should login. Got: ", res.Code, res.Body.String())
+	}
+
+	res = serve("GET", "/auth/me", "", cookie)
+	me := &account{}
+	decodeJSON(res.Body, me)
+	if res.Code != 200 || me.Email != "adphi@example.com" {
+		t.Error("Current user should be returned. Got: ", res.Code, me)
+	}
+
+	if res = serve("POST", "/auth/logout", "", cookie); res.Code != 200 {
+		t.Error("User should logout. Got: ", res.Code)
+	}
+	if res = serve("GET", "/auth/me", "", cookie); res.Code != 401 {
+		t.Error("User should be logged out. Got: ", res.Code)
+	}
+}
+
+// failingStore cannot save sessions
+type failingStore struct{}
+
+func (s failingStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.NewSession(s, name), nil
+}
+
+func (s failingStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.NewSession(s, name), nil
+}
+
+func (s failingStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return errors.New("session store is not available")
+}
+
+func TestSessionError(t *testing.T) {
+	ng, serve := setupAccounts(t)
+	defer ng.Close()
+	ng.session = failingStore{}
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	if res := serve("POST", "/auth/register", body, ""); res.Code != 500 {
+		t.Error("Register should fail without session. Got: ", res.Code, res.Body.String())
+	}
+	res := serve("POST", "/auth/login", body, "")
+	if res.Code != 500 || res.Header().Get("Set-Cookie") != "" {
+		t.Error("Login should fail without session. Got: ", res.Code, res.Body.String())
+	}
+}
+
+func TestPasswordRedaction(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	cache := NewMemoryCache()
+	g.cacher = cache
+	g.registerCacher()
+
+	res := do("POST", "/auth/register", `{"username":"Adphi", "password": "something-secret"}`, "")
+	cookie := res.Header().Get("Set-Cookie")
+	var values map[string]interface{}
+	decodeJSON(res.Body, &values)
+	if _, ok := values["Password"]; ok || values["Username"] != "Adphi" {
+		t.Error("Password should not be returned on register. Got: ", values)
+	}
+
+	for _, path := range []string{"/testuser/1", "/auth/me"} {
+		values = nil
+		decodeJSON(do("GET", path, "", cookie).Body, &values)
+		if _, ok := values["Password"]; ok || values["Username"] != "Adphi" {
+			t.Error("Password should not be returned on ", path, ". Got: ", values)
+		}
+	}
+
+	var results []map[string]interface{}
+	decodeJSON(do("GET", "/query/testuser/"+url.QueryEscape(`{}`), "", cookie).Body, &results)
+	if len(results) != 1 {
+		t.Fatal("User should be queried. Got: ", results)
+	}
+	if _, ok := results[0]["Password"]; ok {
+		t.Error("Password should not be queried. Got: ", results)
+	}
+
+	cached := &testuser{}
+	if err := cache.Get("testuser:1", cached); err != nil || cached.Username != "Adphi" || cached.Password != "" {
+		t.Error("Password should not be cached. Got: ", err, cached)
+	}
+	user := &testuser{}
+	g.db.First(user, 1)
+	if user.Password == "" {
+		t.Error("Password should still be stored")
+	}
+
+	// Goal tables are never cached
+	session := &UserSession{}
+	if err := g.db.First(session).Error; err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := cache.Exists(g.cacheKey(session)); exists {
+		t.Error("Sessions should not be cached")
+	}
+}
@@ -0,0 +1,123 @@
+package goal
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// Broker defines a interface to deliver change events to live queries
+type Broker interface {
+	// Publish is called by goal when a record is created, updated or deleted
+	Publish(*LiveEvent) error
+	// Subscribe returns a channel receiving events until the context is done
+	Subscribe(context.Context) (<-chan *LiveEvent, error)
+	Close() error
+}
+
+// memoryBrokerBuffer is the number of events waiting to be received by a
+// subscriber before new events are dropped
+const memoryBrokerBuffer = 256
+
+// MemoryBroker implements Broker interface inside the process, it works with
+// any database but events are only seen by the goal instance which made the change
+type MemoryBroker struct {
+	mu          sync.RWMutex
+	subscribers map[chan *LiveEvent]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: map[chan *LiveEvent]struct{}{}}
+}
+
+// Publish sends event to all subscribers
+func (b *MemoryBroker) Publish(event *LiveEvent) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			logrus.Warnf("Live query subscriber is too slow, dropping %s event on %s", event.Type, event.Table)
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a new subscriber
+func (b *MemoryBroker) Subscribe(ctx context.Context) (<-chan *LiveEvent, error) {
+	ch := make(chan *LiveEvent, memoryBrokerBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.remove(ch)
+	}()
+	return ch, nil
+}
+
+// Close removes all subscribers
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) remove(ch chan *LiveEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// registerBrokerCallbacks publishes changes once the transaction of their
+// statement is committed, so that failed statements are never seen. Within
+// a transaction begun by the caller, changes are published as soon as the
+// statement runs, even if the transaction is rolled back later
+func (g *Goal) registerBrokerCallbacks() {
+	logrus.Info("Registering DB live queries callbacks")
+	commit := "gorm:commit_or_rollback_transaction"
+	g.db.Callback().Create().After(commit).Register("goal:publish_after_create", g.publisher(LiveCreate))
+	g.db.Callback().Update().After(commit).Register("goal:publish_after_update", g.publisher(LiveUpdate))
+	g.db.Callback().Delete().After(commit).Register("goal:publish_after_delete", g.publisher(LiveDelete))
+}
+
+// publisher returns a callback publishing the record of the scope to the
+// broker. Batch operations, without primary key, are not published, nor
+// the records of models which are not registered, like goal tables
+func (g *Goal) publisher(eventType LiveEventType) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		if scope.HasError() || scope.PrimaryKeyZero() {
+			return
+		}
+
+		if !g.registeredModel(scope.Value) {
+			return
+		}
+		value := reflect.Indirect(reflect.ValueOf(scope.Value))
+
+		// Copy the record as the caller may still modify it
+		object := reflect.New(value.Type())
+		object.Elem().Set(value)
+
+		event := &LiveEvent{Type: eventType, Table: scope.TableName(), Object: g.redactPassword(object.Interface())}
+		if err := g.broker.Publish(event); err != nil {
+			logrus.Errorf("Live query: %v", err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package goal
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
@@ -16,18 +17,30 @@ type Cacher interface {
 	Close() error
 }
 
-func (g *Goal) registerCacher(cache Cacher) {
-	logrus.Info("Registering cache")
-	if g.cacher != nil {
-		// Register Gorm callbacks
-		if g.db != nil {
-			logrus.Info("Registering DB cache callbacks")
-			g.db.Callback().Create().After("gorm:after_create").Register("goal:cache_after_create", g.cache)
-			g.db.Callback().Update().After("gorm:after_update").Register("goal:cache_after_update", g.cache)
-			g.db.Callback().Query().After("gorm:after_query").Register("goal:cache_after_query", g.cache)
-			g.db.Callback().Delete().Before("gorm:before_delete").Register("goal:uncache_after_delete", g.uncache)
-		}
+// TTLCacher is a Cacher whose keys can expire
+type TTLCacher interface {
+	Cacher
+	SetWithTTL(string, interface{}, time.Duration) error
+}
+
+// setWithTTL sets a val for a key, which expires after ttl if
+// cacher supports it
+func setWithTTL(cacher Cacher, key string, val interface{}, ttl time.Duration) error {
+	if ttlCacher, ok := cacher.(TTLCacher); ok {
+		return ttlCacher.SetWithTTL(key, val, ttl)
 	}
+	return cacher.Set(key, val)
+}
+
+// registerCacher caches records automatically by registering
+// callbacks to gorm. Only records of registered models are cached,
+// goal tables store secrets like sessions and TOTP keys
+func (g *Goal) registerCacher() {
+	logrus.Info("Registering DB cache callbacks")
+	g.db.Callback().Create().After("gorm:after_create").Register("goal:cache_after_create", g.cache)
+	g.db.Callback().Update().After("gorm:after_update").Register("goal:cache_after_update", g.cache)
+	g.db.Callback().Query().After("gorm:after_query").Register("goal:cache_after_query", g.cache)
+	g.db.Callback().Delete().Before("gorm:before_delete").Register("goal:uncache_after_delete", g.uncache)
 }
 
 func cacheKeyFromScope(scope *gorm.Scope) string {
@@ -51,6 +64,10 @@ func defaultCacheKey(name string, id interface{}) string {
 
 // uncache data from cache
 func (g *Goal) uncache(scope *gorm.Scope) {
+	// Batch operations have no record to uncache
+	if scope.PrimaryKeyZero() || !g.registeredModel(scope.Value) {
+		return
+	}
 	logrus.Debug("Uncaching query")
 	// Reload object before delete
 	scope.DB().New().First(scope.Value)
@@ -62,7 +79,44 @@ func (g *Goal) uncache(scope *gorm.Scope) {
 
 // cacher data to cache
 func (g *Goal) cache(scope *gorm.Scope) {
+	// Lists and failed queries are not cached
+	if scope.HasError() || scope.PrimaryKeyZero() || !g.registeredModel(scope.Value) {
+		return
+	}
 	logrus.Debug("Caching query")
 	key := cacheKeyFromScope(scope)
-	g.cacher.Set(key, scope.Value)
+	g.cacher.Set(key, g.redactPassword(scope.Value))
+}
+
+// getCached reads the value of key from cacher, it reports whether
+// the value was found
+func (g *Goal) getCached(key string, val interface{}) bool {
+	if g.cacher == nil {
+		return false
+	}
+	exists, err := g.cacher.Exists(key)
+	if err != nil || !exists {
+		return false
+	}
+	return g.cacher.Get(key, val) == nil
+}
+
+// setCached writes the value of key to cacher if there is one
+func (g *Goal) setCached(key string, val interface{}) {
+	if g.cacher == nil {
+		return
+	}
+	if err := g.cacher.Set(key, val); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// uncacheKey removes key from cacher if there is one
+func (g *Goal) uncacheKey(key string) {
+	if g.cacher == nil {
+		return
+	}
+	if err := g.cacher.Delete(key); err != nil {
+		logrus.Error(err)
+	}
 }
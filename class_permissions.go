@@ -0,0 +1,280 @@
+// class_permissions defines who can perform each action on every record
+// of a model, like Parse class-level permissions. They are stored in
+// database so they can be changed at runtime:
+// {
+//   "read": {"public": true},
+//   "create": {"authenticated": true},
+//   "delete": {"roles": ["admin"], "users": ["42"]}
+// }
+
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Permit defines who can perform an action. Nobody can if it is empty
+type Permit struct {
+	// Public allows everyone, including anonymous users
+	Public bool `json:"public,omitempty"`
+	// Authenticated allows every logged in user
+	Authenticated bool `json:"authenticated,omitempty"`
+	// Roles allows the users with one of the roles
+	Roles []string `json:"roles,omitempty"`
+	// Users allows the users by primary key
+	Users []string `json:"users,omitempty"`
+}
+
+// ClassPermissions defines who can perform each action on every record
+// of a model. An action which is not defined is not allowed
+type ClassPermissions map[Action]Permit
+
+// classPermission stores the class permissions of a table
+type classPermission struct {
+	Class       string `gorm:"primary_key"`
+	Permissions string `gorm:"type:text"`
+}
+
+func (classPermission) TableName() string {
+	return "goal_class_permissions"
+}
+
+var (
+	ErrUnknownAction = errors.New("unknown action")
+	ErrUnknownClass  = errors.New("unknown class")
+)
+
+// validActions are the actions allowed in class permissions
+var validActions = map[Action]bool{
+	ActionCreate: true,
+	ActionRead:   true,
+	ActionUpdate: true,
+	ActionDelete: true,
+	ActionQuery:  true,
+}
+
+// classPermissions returns the permissions of a ResourceACL, where
+// allowed actions are public
+func (a ResourceACL) classPermissions() ClassPermissions {
+	p := ClassPermissions{}
+	allowed := map[Action]bool{
+		ActionCreate: a.Create,
+		ActionRead:   a.Read,
+		ActionUpdate: a.Update,
+		ActionDelete: a.Delete,
+		ActionQuery:  a.Query,
+	}
+	for action, ok := range allowed {
+		if ok {
+			p[action] = Permit{Public: true}
+		}
+	}
+	return p
+}
+
+// ClassPermissions returns the permissions of the model: the ones set at
+// runtime, or the ones of the ResourceACL used to register it
+func (g *Goal) ClassPermissions(resource interface{}) (ClassPermissions, error) {
+	p, _, err := g.classPermissions(reflect.TypeOf(resource))
+	return p, err
+}
+
+// storedClassPermissions is cached for every class, so that permissions
+// are not read from database on each request
+type storedClassPermissions struct {
+	Stored      bool             `json:"stored"`
+	Permissions ClassPermissions `json:"permissions,omitempty"`
+}
+
+// classPermissionsCacheKey returns the cache key of the permissions
+// stored for class
+func classPermissionsCacheKey(class string) string {
+	return defaultCacheKey("goal_class_permissions:stored", class)
+}
+
+// classPermissions returns the permissions of the model, and whether they
+// were set at runtime
+func (g *Goal) classPermissions(rType reflect.Type) (ClassPermissions, bool, error) {
+	stored, err := g.storedClassPermissions(g.tableName(newObjectWithType(rType)))
+	if err != nil {
+		return nil, false, err
+	}
+	if !stored.Stored {
+		return g.resources[rType].classPermissions(), false, nil
+	}
+	return stored.Permissions, true, nil
+}
+
+// storedClassPermissions returns the permissions set at runtime for class
+func (g *Goal) storedClassPermissions(class string) (*storedClassPermissions, error) {
+	key := classPermissionsCacheKey(class)
+	stored := &storedClassPermissions{}
+	if g.getCached(key, stored) {
+		return stored, nil
+	}
+
+	record := &classPermission{}
+	err := g.db.Where("class = ?", class).First(record).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if err == nil {
+		stored.Stored = true
+		if err = json.Unmarshal([]byte(record.Permissions), &stored.Permissions); err != nil {
+			return nil, err
+		}
+	}
+
+	g.setCached(key, stored)
+	return stored, nil
+}
+
+// SetClassPermissions stores the permissions of the model, replacing
+// the ones of its ResourceACL
+func (g *Goal) SetClassPermissions(resource interface{}, permissions ClassPermissions) error {
+	for action := range permissions {
+		if !validActions[action] {
+			return ErrUnknownAction
+		}
+	}
+
+	data, err := json.Marshal(permissions)
+	if err != nil {
+		return err
+	}
+
+	record := &classPermission{Class: g.tableName(resource), Permissions: string(data)}
+	if err = g.db.Save(record).Error; err != nil {
+		return err
+	}
+	g.uncacheKey(classPermissionsCacheKey(record.Class))
+	return nil
+}
+
+// ResetClassPermissions removes the permissions set at runtime, the ones
+// of the ResourceACL are used again
+func (g *Goal) ResetClassPermissions(resource interface{}) error {
+	class := g.tableName(resource)
+	if err := g.db.Where("class = ?", class).Delete(&classPermission{}).Error; err != nil {
+		return err
+	}
+	g.uncacheKey(classPermissionsCacheKey(class))
+	return nil
+}
+
+// checkPermit checks if current user is allowed by the permit
+func (g *Goal) checkPermit(request *http.Request, permit Permit) error {
+	if permit.Public {
+		return nil
+	}
+
+	user, err := g.getCurrentUser(request)
+	if err != nil || user == nil {
+		return ErrUnauthorized
+	}
+
+	if permit.Authenticated {
+		return nil
+	}
+
+	id := fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue())
+	for _, allowed := range permit.Users {
+		if allowed == id {
+			return nil
+		}
+	}
+
+	if hasRole(g.userRoles(user), permit.Roles) {
+		return nil
+	}
+
+	return ErrUnauthorized
+}
+
+// guard wraps handler with the class permission check of the action.
+// Custom handlers are only checked against permissions set at runtime,
+// as they are not bound to the ResourceACL
+func (g *Goal) guard(resource interface{}, action Action, handler simpleResponse, custom bool) simpleResponse {
+	if handler == nil {
+		return nil
+	}
+	return func(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+		permissions, stored, err := g.classPermissions(reflect.TypeOf(resource))
+		if err != nil {
+			return 500, nil, err
+		}
+		if custom && !stored {
+			return handler(rw, request)
+		}
+		if err = g.checkPermit(request, permissions[action]); err != nil {
+			return 403, nil, err
+		}
+		return handler(rw, request)
+	}
+}
+
+// classPermissionsHandler lets administrators read, set and reset
+// the class permissions of a model
+func (g *Goal) classPermissionsHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	// Without administrator roles, nobody can change permissions
+	if len(g.c.adminRoles) == 0 {
+		return 403, nil, ErrUnauthorized
+	}
+	if err := g.checkRoles(request, g.c.adminRoles); err != nil {
+		return 403, nil, err
+	}
+
+	rType, ok := g.resourceType(mux.Vars(request)["table"])
+	if !ok {
+		return 404, nil, ErrUnknownClass
+	}
+	resource := newObjectWithType(rType)
+
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		permissions := ClassPermissions{}
+		if err := json.NewDecoder(request.Body).Decode(&permissions); err != nil {
+			return 400, nil, err
+		}
+		if err := g.SetClassPermissions(resource, permissions); err != nil {
+			if err == ErrUnknownAction {
+				return 400, nil, err
+			}
+			return 500, nil, err
+		}
+	case http.MethodDelete:
+		if err := g.ResetClassPermissions(resource); err != nil {
+			return 500, nil, err
+		}
+	default:
+		return 405, nil, http.ErrNotSupported
+	}
+
+	permissions, err := g.ClassPermissions(resource)
+	if err != nil {
+		return 500, nil, err
+	}
+	return 200, permissions, nil
+}
+
+// AddClassPermissionsPath lets administrators manage class permissions
+// on path, which must define a "table" variable
+func (g *Goal) AddClassPermissionsPath(path string) {
+	g.mux.HandleFunc(path, func(rw http.ResponseWriter, request *http.Request) {
+		g.renderJSON(rw, request, g.classPermissionsHandler)
+	})
+}
+
+// AddDefaultAdminPaths adds administration paths, they are only
+// allowed to the users with one of the administrator roles
+func (g *Goal) AddDefaultAdminPaths() {
+	g.AddClassPermissionsPath("/admin/permissions/{table}")
+}
@@ -17,6 +17,30 @@ func (g *Goal) tableName(resource interface{}) string {
 	return name
 }
 
+// resourceType returns the type of the registered resource stored in table
+func (g *Goal) resourceType(table string) (reflect.Type, bool) {
+	for rType := range g.resources {
+		if g.tableName(newObjectWithType(rType)) == table {
+			return rType, true
+		}
+	}
+	return nil, false
+}
+
+// registeredModel reports whether the value is a record of a model
+// registered with RegisterModel
+func (g *Goal) registeredModel(value interface{}) bool {
+	t := reflect.TypeOf(value)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return false
+	}
+	_, ok := g.resources[reflect.PtrTo(t)]
+	return ok
+}
+
 // Error message should be a json object, with error message
 // and any optional data
 func getErrorString(data interface{}, err error) string {
@@ -38,7 +62,7 @@ func getErrorString(data interface{}, err error) string {
 }
 
 // Write response back to client
-func renderJSON(rw http.ResponseWriter, request *http.Request, handler simpleResponse) {
+func (g *Goal) renderJSON(rw http.ResponseWriter, request *http.Request, handler simpleResponse) {
 	if handler == nil {
 		http.Error(rw, http.ErrNotSupported.Error(), http.StatusMethodNotAllowed)
 		return
@@ -46,6 +70,14 @@ func renderJSON(rw http.ResponseWriter, request *http.Request, handler simpleRes
 
 	code, data, err := handler(rw, request)
 
+	// Remove the fields current user cannot read, errors may also
+	// return a record
+	data, filterErr := g.filterFields(request, data)
+	if filterErr != nil {
+		http.Error(rw, getErrorString(nil, filterErr), http.StatusInternalServerError)
+		return
+	}
+
 	if err != nil {
 		http.Error(rw, getErrorString(data, err), code)
 		return
@@ -63,15 +95,21 @@ func renderJSON(rw http.ResponseWriter, request *http.Request, handler simpleRes
 	rw.Write(content)
 }
 
-// RegisterModel initializes default routes for a model
-func (g *Goal) RegisterModel(resource interface{}, access ResourceACL) {
+// RegisterModel initializes default routes for a model. Policies
+// restrict the records each user can access
+func (g *Goal) RegisterModel(resource interface{}, access ResourceACL, policies ...Policy) {
 	logrus.Infof("Registering model : %s", g.tableName(resource))
 	g.db.AutoMigrate(resource)
 	if g.resources == nil {
 		g.resources = map[reflect.Type]ResourceACL{}
 	}
 	g.resources[reflect.TypeOf(resource)] = access
+	g.AddPolicies(resource, policies...)
+	// Events path must be added before the crud paths, as "events"
+	// would be matched as an id
+	g.AddDefaultEventsPath(resource)
 	g.AddDefaultCrudPaths(resource)
+	g.AddDefaultACLPath(resource)
 	g.AddDefaultQueryPath(resource)
 }
 
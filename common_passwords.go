@@ -0,0 +1,29 @@
+package goal
+
+// commonPasswords are among the most used passwords found in leaks,
+// they are rejected whatever the other rules of the policy
+var commonPasswords = []string{
+	"000000", "00000000", "0987654321", "102030", "111111", "1111111", "11111111",
+	"112233", "121212", "123123", "123123123", "123321", "1234", "12345", "123456",
+	"1234567", "12345678", "123456789", "1234567890", "123456a", "123654", "123abc",
+	"123qwe", "131313", "147258", "147258369", "159753", "1q2w3e", "1q2w3e4r",
+	"1q2w3e4r5t", "1qaz2wsx", "222222", "22222222", "333333", "444444", "555555",
+	"654321", "666666", "6969", "696969", "777777", "7777777", "888888", "88888888",
+	"987654321", "999999", "99999999", "a123456", "aa123456", "aaaaaa", "abc123",
+	"abcd1234", "abcdef", "access", "admin", "admin123", "administrator", "amanda",
+	"andrew", "asdf", "asdf1234", "asdfasdf", "asdfgh", "asdfghjk", "asdfghjkl",
+	"ashley", "austin", "azerty", "azertyuiop", "bailey", "baseball", "batman",
+	"biteme", "buster", "changeme", "charlie", "cheese", "chelsea", "chocolate",
+	"computer", "cookie", "daniel", "dragon", "default", "donald", "football",
+	"freedom", "fuckyou", "ginger", "hannah", "hello", "hello123", "hockey",
+	"hunter", "hunter2", "iloveyou", "internet", "jennifer", "jessica", "jordan",
+	"joshua", "justin", "killer", "letmein", "liverpool", "login", "london",
+	"lovely", "loveme", "maggie", "master", "matrix", "matthew", "merlin",
+	"michael", "michelle", "monkey", "mustang", "nicole", "ninja", "passw0rd",
+	"password", "password1", "password12", "password123", "password1234", "pepper",
+	"princess", "pussy", "qazwsx", "qwe123", "qwer1234", "qwerty", "qwerty123",
+	"qwerty1234", "qwertyuiop", "robert", "root", "secret", "shadow", "soccer",
+	"starwars", "summer", "sunshine", "superman", "taylor", "test", "test123",
+	"thomas", "tigger", "trustno1", "welcome", "welcome1", "whatever", "william",
+	"winter", "zaq12wsx", "zxcvbn", "zxcvbnm",
+}
@@ -43,18 +43,31 @@ type PatchSupporter interface {
 	Patch(http.ResponseWriter, *http.Request) (int, interface{}, error)
 }
 
+// methodActions defines the action checked for each HTTP method
+var methodActions = map[string]Action{
+	http.MethodGet:    ActionRead,
+	http.MethodHead:   ActionRead,
+	http.MethodPost:   ActionCreate,
+	http.MethodPut:    ActionUpdate,
+	http.MethodPatch:  ActionUpdate,
+	http.MethodDelete: ActionDelete,
+}
+
 // Route request to correct handler and write result back to client
 func (g *Goal) crudHandler(resource interface{}) http.HandlerFunc {
 	return func(rw http.ResponseWriter, request *http.Request) {
 		var handler simpleResponse
+		// custom is true when the resource handles the method itself
+		custom := false
 
 		switch request.Method {
 		case http.MethodGet:
 			if resource, ok := resource.(GetSupporter); ok {
 				handler = resource.Get
+				custom = true
 				break
 			}
-			if a, ok := g.resources[reflect.TypeOf(resource)]; ok && a.Read {
+			if _, ok := g.resources[reflect.TypeOf(resource)]; ok {
 				handler = func(writer http.ResponseWriter, r *http.Request) (int, interface{}, error) {
 					return g.read(reflect.TypeOf(resource), r)
 				}
@@ -62,9 +75,10 @@ func (g *Goal) crudHandler(resource interface{}) http.HandlerFunc {
 		case http.MethodPost:
 			if resource, ok := resource.(PostSupporter); ok {
 				handler = resource.Post
+				custom = true
 				break
 			}
-			if a, ok := g.resources[reflect.TypeOf(resource)]; ok && a.Create {
+			if _, ok := g.resources[reflect.TypeOf(resource)]; ok {
 				handler = func(writer http.ResponseWriter, r *http.Request) (int, interface{}, error) {
 					return g.create(reflect.TypeOf(resource), r)
 				}
@@ -72,9 +86,10 @@ func (g *Goal) crudHandler(resource interface{}) http.HandlerFunc {
 		case http.MethodPut:
 			if resource, ok := resource.(PutSupporter); ok {
 				handler = resource.Put
+				custom = true
 				break
 			}
-			if a, ok := g.resources[reflect.TypeOf(resource)]; ok && a.Update {
+			if _, ok := g.resources[reflect.TypeOf(resource)]; ok {
 				handler = func(writer http.ResponseWriter, r *http.Request) (int, interface{}, error) {
 					return g.update(reflect.TypeOf(resource), r)
 				}
@@ -82,9 +97,10 @@ func (g *Goal) crudHandler(resource interface{}) http.HandlerFunc {
 		case http.MethodDelete:
 			if resource, ok := resource.(DeleteSupporter); ok {
 				handler = resource.Delete
+				custom = true
 				break
 			}
-			if a, ok := g.resources[reflect.TypeOf(resource)]; ok && a.Delete {
+			if _, ok := g.resources[reflect.TypeOf(resource)]; ok {
 				handler = func(writer http.ResponseWriter, r *http.Request) (int, interface{}, error) {
 					return g.delete(reflect.TypeOf(resource), r)
 				}
@@ -92,14 +108,20 @@ func (g *Goal) crudHandler(resource interface{}) http.HandlerFunc {
 		case http.MethodHead:
 			if resource, ok := resource.(HeadSupporter); ok {
 				handler = resource.Head
+				custom = true
 			}
 		case http.MethodPatch:
 			if resource, ok := resource.(PatchSupporter); ok {
 				handler = resource.Patch
+				custom = true
 			}
 		}
 
-		renderJSON(rw, request, handler)
+		if action, ok := methodActions[request.Method]; ok {
+			handler = g.guard(resource, action, handler, custom)
+		}
+
+		g.renderJSON(rw, request, handler)
 	}
 }
 
@@ -112,6 +134,8 @@ func (g *Goal) AddCrudResource(resource interface{}, paths ...string) {
 	}
 }
 
+// ResourceACL defines the actions allowed to everyone on a model,
+// until class permissions are set at runtime
 type ResourceACL struct {
 	Create bool
 	Read   bool
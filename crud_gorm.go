@@ -7,12 +7,34 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
+// scopes returns the non nil scopes
+func scopes(scopes ...func(*gorm.DB) *gorm.DB) []func(*gorm.DB) *gorm.DB {
+	var result []func(*gorm.DB) *gorm.DB
+	for _, scope := range scopes {
+		if scope != nil {
+			result = append(result, scope)
+		}
+	}
+	return result
+}
+
+// errorCode returns 404 if the record was not found, or if it is
+// hidden by a policy, and 500 otherwise
+func errorCode(err error) int {
+	if gorm.IsRecordNotFoundError(err) {
+		return 404
+	}
+	return 500
+}
+
 // read provides basic implementation to retrieve object
 // based on request parameters
 func (g *Goal) read(rType reflect.Type, request *http.Request) (int, interface{}, error) {
@@ -28,10 +50,15 @@ func (g *Goal) read(rType reflect.Type, request *http.Request) (int, interface{}
 
 	resource := newObjectWithType(rType)
 
+	// Restrict to the records user can access
+	policy, err := g.policyScope(rType, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
 	// Attempt to retrieve from redis first, if not exist, retrieve from
-	// database and cacher it
-	var err error
-	if g.cacher != nil {
+	// database and cacher it. Cache is skipped when the model has policies
+	if g.cacher != nil && policy == nil {
 		name := g.tableName(resource)
 		redisKey := defaultCacheKey(name, id)
 		err = g.cacher.Get(redisKey, resource)
@@ -47,15 +74,15 @@ func (g *Goal) read(rType reflect.Type, request *http.Request) (int, interface{}
 	}
 
 	// Retrieve from database
-	err = g.db.Where("id = ?", id).First(resource).Error
+	err = g.db.Scopes(scopes(policy)...).Where("id = ?", id).First(resource).Error
 	if err != nil {
-		return 500, nil, err
+		return errorCode(err), nil, err
 	}
 
 	// Save to redis
 	if g.cacher != nil {
 		key := g.cacheKey(resource)
-		g.cacher.Set(key, resource)
+		g.cacher.Set(key, g.redactPassword(resource))
 	}
 
 	// Check if resource is authorized
@@ -72,14 +99,42 @@ func (g *Goal) read(rType reflect.Type, request *http.Request) (int, interface{}
 func (g *Goal) create(rType reflect.Type, request *http.Request) (int, interface{}, error) {
 	resource := newObjectWithType(rType)
 
+	// Check permission before the request body is decoded, so that
+	// the client cannot set the fields read by PermitCreate
+	err := g.CanPerformAction(resource, request, ActionCreate)
+	if err != nil {
+		return 403, nil, err
+	}
+
 	// Parse request body into resource
-	decoder := json.NewDecoder(request.Body)
-	err := decoder.Decode(resource)
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return 500, nil, err
+	}
+	err = json.Unmarshal(body, resource)
 	if err != nil {
 		fmt.Println(err)
 		return 500, nil, err
 	}
 
+	// Check protected fields
+	err = g.checkWritableFields(resource, body, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
+	// Give default roles to the record
+	err = g.applyDefaultACL(resource, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
+	// Set or check policy columns
+	err = g.enforcePolicies(resource, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
 	// Save to database
 	err = g.db.Create(resource).Error
 	if err != nil {
@@ -106,23 +161,50 @@ func (g *Goal) update(rType reflect.Type, request *http.Request) (int, interface
 
 	// Parse request body into updatedObj
 	updatedObj := newObjectWithType(rType)
-	decoder := json.NewDecoder(request.Body)
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return 500, nil, err
+	}
 
-	err := decoder.Decode(updatedObj)
+	err = json.Unmarshal(body, updatedObj)
 	if err != nil {
 		fmt.Println(err)
 		return 500, nil, err
 	}
 
+	// Roles of the record are changed with the ACL path only. Blank
+	// fields are not updated
+	if permission := embeddedPermission(updatedObj); permission != nil {
+		*permission = Permission{}
+	}
+
+	// Restrict to the records user can access
+	policy, err := g.policyScope(rType, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
 	// Retrieve from database
-	err = g.db.Where("id = ?", id).First(resource).Error
+	err = g.db.Scopes(scopes(policy)...).Where("id = ?", id).First(resource).Error
 	if err != nil {
 		fmt.Println(err)
-		return 500, nil, err
+		return errorCode(err), nil, err
 	}
 
 	// Check permission
-	err = g.CanPerform(resource, request, false)
+	err = g.CanPerformAction(resource, request, ActionUpdate)
+	if err != nil {
+		return 403, nil, err
+	}
+
+	// Check protected fields
+	err = g.checkWritableFields(updatedObj, body, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
+	// Record cannot be given to another user
+	err = g.enforcePolicies(updatedObj, request)
 	if err != nil {
 		return 403, nil, err
 	}
@@ -169,14 +251,20 @@ func (g *Goal) delete(rType reflect.Type, request *http.Request) (int, interface
 
 	resource := newObjectWithType(rType)
 
+	// Restrict to the records user can access
+	policy, err := g.policyScope(rType, request)
+	if err != nil {
+		return 403, nil, err
+	}
+
 	// Retrieve from database
-	err := g.db.Where("id = ?", id).First(resource).Error
+	err = g.db.Scopes(scopes(policy)...).Where("id = ?", id).First(resource).Error
 	if err != nil {
-		return 500, nil, err
+		return errorCode(err), nil, err
 	}
 
 	// Check permission
-	err = g.CanPerform(resource, request, false)
+	err = g.CanPerformAction(resource, request, ActionDelete)
 	if err != nil {
 		return 403, nil, err
 	}
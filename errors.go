@@ -5,7 +5,11 @@ import "errors"
 var (
 	ErrNilContext             = errors.New("context cannot be nil")
 	ErrNilCache               = errors.New("cacher cannot be nil")
+	ErrNilBroker              = errors.New("broker cannot be nil")
+	ErrNilTLSConfig           = errors.New("tls config cannot be nil")
+	ErrNilCertificateProvider = errors.New("certificate provider cannot be nil")
+	ErrEmptyTLSFiles          = errors.New("tls certificate and key files cannot be empty")
 	ErrEmptyDBAddress         = errors.New("db address cannot be empty")
 	ErrEmptyDBDriver          = errors.New("db driver cannot be empty")
-	ErrLiveQueryUnsupportedDB = errors.New("livequeries only supports postgres database")
+	ErrLiveQueryUnsupportedDB = errors.New("pqstream only supports postgres database")
 )
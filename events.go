@@ -0,0 +1,218 @@
+// events streams the changes of a model with Server-Sent Events,
+// for clients which cannot use WebSocket. Optional "query" url parameter
+// filters the records like the query endpoint:
+// GET /article/events?query={"where":[{"key": "title", "op": "=", "val": "news"}]}
+
+package goal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventStreamBuffer is the number of events waiting to be sent to a
+	// client before the stream is closed
+	eventStreamBuffer = 64
+	// eventStreamKeepAlive is the interval between comments sent to keep
+	// the connection open through proxies
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// liveRecord is an event with its id, used to resume a stream
+type liveRecord struct {
+	id    uint64
+	event *LiveEvent
+}
+
+// eventStream is a client connected to the events endpoint
+type eventStream struct {
+	table   string
+	params  *queryParams
+	request *http.Request
+	send    chan *liveRecord
+	// done is closed when the stream ends, senders must not block after
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// close ends the stream
+func (s *eventStream) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// remember adds record to the history of its table, keeping
+// only the last ones
+func (l *liveQueries) remember(record *liveRecord) {
+	size := l.g.c.replaySize
+	if size <= 0 {
+		return
+	}
+
+	history := append(l.history[record.event.Table], record)
+	if len(history) > size {
+		history = history[len(history)-size:]
+	}
+	l.history[record.event.Table] = history
+}
+
+// replay returns the records of table sent after the last id
+func (l *liveQueries) replay(table string, last uint64) []*liveRecord {
+	var records []*liveRecord
+	for _, record := range l.history[table] {
+		if record.id > last {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func (l *liveQueries) eventsHandler(table string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			http.Error(rw, http.ErrNotSupported.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			http.Error(rw, getErrorString(nil, http.ErrNotSupported), http.StatusInternalServerError)
+			return
+		}
+
+		params, err := l.queryParams(table, []byte(request.URL.Query().Get("query")), request)
+		if err == ErrLiveQueryNotAllowed {
+			http.Error(rw, getErrorString(nil, err), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(rw, getErrorString(nil, err), http.StatusBadRequest)
+			return
+		}
+
+		// Browsers send the id of the last received event when reconnecting
+		var last uint64
+		lastID := request.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = request.URL.Query().Get("lastEventId")
+		}
+		if lastID != "" {
+			last, err = strconv.ParseUint(lastID, 10, 64)
+			if err != nil {
+				http.Error(rw, getErrorString(nil, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		stream := &eventStream{
+			table:   table,
+			params:  params,
+			request: request,
+			send:    make(chan *liveRecord, eventStreamBuffer),
+			done:    make(chan struct{}),
+		}
+
+		// Register the stream and read the history at once, so that no event is
+		// missed or sent twice
+		l.mu.Lock()
+		var replayed []*liveRecord
+		if lastID != "" {
+			replayed = l.replay(table, last)
+		}
+		l.streams[stream] = struct{}{}
+		l.mu.Unlock()
+
+		defer func() {
+			l.mu.Lock()
+			delete(l.streams, stream)
+			l.mu.Unlock()
+			stream.close()
+		}()
+
+		// Access is checked outside the lock, as it may query the database
+		var missed []*liveRecord
+		for _, record := range replayed {
+			if l.allowed(table, params, request, record.event) {
+				missed = append(missed, record)
+			}
+		}
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("Connection", "keep-alive")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for _, record := range missed {
+			if err := l.writeEvent(rw, request, record); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventStreamKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-request.Context().Done():
+				return
+			case <-l.g.ctx.Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case <-stream.done:
+				return
+			case record := <-stream.send:
+				if err := l.writeEvent(rw, request, record); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes record with Server-Sent Events format, without
+// the fields the client cannot read
+func (l *liveQueries) writeEvent(rw http.ResponseWriter, request *http.Request, record *liveRecord) error {
+	object, err := l.g.filterFields(request, record.event.Object)
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+
+	_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", record.id, record.event.Type, data)
+	return err
+}
+
+// AddEventsPath streams the changes of resource on path
+func (g *Goal) AddEventsPath(resource interface{}, path string) {
+	if g.live == nil {
+		return
+	}
+	g.mux.Handle(path, g.live.eventsHandler(g.tableName(resource)))
+}
+
+// AddDefaultEventsPath streams the changes of resource on a path
+// based on struct name
+func (g *Goal) AddDefaultEventsPath(resource interface{}) {
+	eventsPath := fmt.Sprintf("/%s/events", g.tableName(resource))
+	g.AddEventsPath(resource, eventsPath)
+}
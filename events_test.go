@@ -0,0 +1,84 @@
+package goal
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads the next event of a Server-Sent Events stream
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 {
+			event[parts[0]] = parts[1]
+		}
+	}
+}
+
+// waitHistory waits until n events of table are dispatched and kept for replay
+func waitHistory(t *testing.T, live *Goal, table string, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		live.live.mu.RLock()
+		count := len(live.live.history[table])
+		live.live.mu.RUnlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%d events of %s should be dispatched", n, table)
+}
+
+func TestEvents(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+
+	// Created before connection, only sent when resuming
+	live.db.Create(&testuser{Name: "Thomas", Age: 28})
+	live.db.Create(&testuser{Name: "Alan", Age: 30})
+	waitHistory(t, live, "testuser", 2)
+
+	query := url.QueryEscape(`{"where":[{"key": "age", "op": ">", "val": 25}]}`)
+	req, _ := http.NewRequest("GET", server.URL+"/testuser/events?query="+query, nil)
+	req.Header.Set("Last-Event-ID", "1")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Request Failed ", res.StatusCode)
+	}
+
+	reader := bufio.NewReader(res.Body)
+	event := readEvent(t, reader)
+	if event["id"] != "2" || event["event"] != "create" || !strings.Contains(event["data"], "Alan") {
+		t.Error("Should replay creation of Alan, got: ", event)
+	}
+
+	// Filtered by the query
+	live.db.Create(&testuser{Name: "Jason", Age: 22})
+	live.db.Create(&testuser{Name: "Ben", Age: 40})
+
+	event = readEvent(t, reader)
+	if event["id"] != "4" || !strings.Contains(event["data"], "Ben") {
+		t.Error("Should receive creation of Ben, got: ", event)
+	}
+}
@@ -0,0 +1,329 @@
+// fields restricts who can read and write each field of a model,
+// with the goal struct tag:
+// type user struct {
+//   Password string `goal:"hidden"`
+//   Email    string `goal:"read=admin|support"`
+//   Verified bool   `goal:"readonly"`
+//   Roles    string `goal:"write=admin"`
+// }
+
+package goal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// fieldRule is the access control of a field
+type fieldRule struct {
+	// hidden fields are never rendered
+	hidden bool
+	// readonly fields cannot be written by clients
+	readonly bool
+	// read and write restrict the field to users with one of the roles
+	read  []string
+	write []string
+}
+
+// protected reports whether the rule restricts the field
+func (r fieldRule) protected() bool {
+	return r.hidden || r.readonly || len(r.read) > 0 || len(r.write) > 0
+}
+
+func (r fieldRule) canRead(roles []string) bool {
+	return !r.hidden && (len(r.read) == 0 || hasRole(roles, r.read))
+}
+
+func (r fieldRule) canWrite(roles []string) bool {
+	return !r.readonly && (len(r.write) == 0 || hasRole(roles, r.write))
+}
+
+// parseFieldRule parses a goal struct tag
+func parseFieldRule(tag string) fieldRule {
+	var rule fieldRule
+	for _, option := range strings.Split(tag, ",") {
+		option = strings.TrimSpace(option)
+		switch {
+		case option == "hidden":
+			rule.hidden = true
+		case option == "readonly":
+			rule.readonly = true
+		case strings.HasPrefix(option, "read="):
+			rule.read = strings.Split(strings.TrimPrefix(option, "read="), "|")
+		case strings.HasPrefix(option, "write="):
+			rule.write = strings.Split(strings.TrimPrefix(option, "write="), "|")
+		}
+	}
+	return rule
+}
+
+// jsonField is a field of a struct as seen by encoding/json
+type jsonField struct {
+	name   string
+	goName string
+	index  []int
+	rule   fieldRule
+}
+
+// jsonFieldsCache stores the fields of each struct type
+var jsonFieldsCache sync.Map
+
+// jsonFields returns the fields of a struct type rendered in JSON,
+// including the fields of embedded structs
+func jsonFields(t reflect.Type) []jsonField {
+	if fields, ok := jsonFieldsCache.Load(t); ok {
+		return fields.([]jsonField)
+	}
+
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		fieldType := f.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if f.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			for _, embedded := range jsonFields(fieldType) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name: name, goName: f.Name, index: []int{i}, rule: parseFieldRule(f.Tag.Get("goal"))})
+	}
+
+	jsonFieldsCache.Store(t, fields)
+	return fields
+}
+
+// modelFields returns the fields of a struct type, with the password
+// of the user model always hidden
+func (g *Goal) modelFields(t reflect.Type) []jsonField {
+	fields := jsonFields(t)
+	password := g.passwordField()
+	if t != g.userType || password == "" {
+		return fields
+	}
+
+	// Fields are shared between goal instances
+	hidden := make([]jsonField, len(fields))
+	copy(hidden, fields)
+	for i := range hidden {
+		if hidden[i].goName == password {
+			hidden[i].rule.hidden = true
+		}
+	}
+	return hidden
+}
+
+// fieldByIndex returns the field of v, or an invalid value if
+// an embedded pointer is nil
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return reflect.Value{}
+				}
+				v = v.Elem()
+			}
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// hasFieldRules reports whether a value contains a struct with protected fields
+func (g *Goal) hasFieldRules(v reflect.Value) bool {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	if v.Type().Implements(marshalerType) || reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, f := range g.modelFields(v.Type()) {
+			if f.rule.protected() {
+				return true
+			}
+			if field := fieldByIndex(v, f.index); field.IsValid() && g.hasFieldRules(field) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if g.hasFieldRules(v.Index(i)) {
+				return true
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			if g.hasFieldRules(v.MapIndex(key)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripFields removes from the decoded JSON of v the fields
+// which cannot be read with the roles
+func (g *Goal) stripFields(data interface{}, v reflect.Value, roles []string) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Type().Implements(marshalerType) || reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, f := range g.modelFields(v.Type()) {
+			if !f.rule.canRead(roles) {
+				delete(object, f.name)
+				continue
+			}
+			if field := fieldByIndex(v, f.index); field.IsValid() {
+				g.stripFields(object[f.name], field, roles)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := data.([]interface{})
+		if !ok {
+			return
+		}
+		for i := 0; i < v.Len() && i < len(list); i++ {
+			g.stripFields(list[i], v.Index(i), roles)
+		}
+	case reflect.Map:
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, key := range v.MapKeys() {
+			if key.Kind() == reflect.String {
+				g.stripFields(object[key.String()], v.MapIndex(key), roles)
+			}
+		}
+	}
+}
+
+// filterFields returns data without the fields current user cannot read.
+// Data is returned as is if it has no protected field
+func (g *Goal) filterFields(request *http.Request, data interface{}) (interface{}, error) {
+	if data == nil || !g.hasFieldRules(reflect.ValueOf(data)) {
+		return data, nil
+	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep numbers as is, large integers would lose precision as float64
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err = decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	g.stripFields(decoded, reflect.ValueOf(data), g.currentRoles(request))
+	return decoded, nil
+}
+
+// readableColumn reports whether the field of the model is rendered to
+// users with the roles. Hidden fields, fields without json name, the user
+// password and fields restricted to other roles are not. Clients cannot
+// filter nor sort on them, results would leak their values
+func (g *Goal) readableColumn(scope *gorm.Scope, field *gorm.Field, roles []string) bool {
+	for _, f := range g.modelFields(scope.GetModelStruct().ModelType) {
+		if f.goName == field.Name {
+			return f.rule.canRead(roles)
+		}
+	}
+	return false
+}
+
+var ErrFieldNotWritable = errors.New("field is not writable")
+
+// checkWritableFields fails if the body sets a field of the resource
+// current user cannot write. Only the fields of the model itself are
+// checked, not the ones of its associations
+func (g *Goal) checkWritableFields(resource interface{}, body []byte, request *http.Request) error {
+	t := reflect.TypeOf(resource)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var protected []jsonField
+	for _, f := range jsonFields(t) {
+		if f.rule.readonly || len(f.rule.write) > 0 {
+			protected = append(protected, f)
+		}
+	}
+	if len(protected) == 0 {
+		return nil
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(body, &values); err != nil {
+		return err
+	}
+
+	var roles []string
+	rolesLoaded := false
+	for key := range values {
+		for _, f := range protected {
+			// encoding/json matches keys without case
+			if !strings.EqualFold(key, f.name) {
+				continue
+			}
+			if !rolesLoaded {
+				roles = g.currentRoles(request)
+				rolesLoaded = true
+			}
+			if !f.rule.canWrite(roles) {
+				return ErrFieldNotWritable
+			}
+		}
+	}
+	return nil
+}
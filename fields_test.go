@@ -0,0 +1,155 @@
+package goal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type profile struct {
+	ID     uint `gorm:"primary_key"`
+	Name   string
+	Secret string `goal:"hidden"`
+	Email  string `goal:"read=testuser:1"`
+	Level  int    `goal:"readonly"`
+	Badge  string `goal:"write=testuser:1|admin"`
+}
+
+func TestFieldPermissions(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.RegisterModel(&profile{}, AllACL())
+
+	_, adminCookie := registerUser(t, "admin")
+	_, userCookie := registerUser(t, "user")
+
+	p := &profile{Name: "Adphi", Secret: "secret", Email: "adphi@example.com", Level: 1}
+	g.db.Create(p)
+	path := fmt.Sprint("/profile/", p.ID)
+
+	var values map[string]interface{}
+	decodeJSON(do("GET", path, "", userCookie).Body, &values)
+	if _, ok := values["Secret"]; ok {
+		t.Error("Hidden field should not be rendered. Got: ", values)
+	}
+	if _, ok := values["Email"]; ok {
+		t.Error("Email should only be rendered to testuser:1. Got: ", values)
+	}
+	if values["Name"] != "Adphi" {
+		t.Error("Public field should be rendered. Got: ", values)
+	}
+
+	values = nil
+	decodeJSON(do("GET", path, "", adminCookie).Body, &values)
+	if _, ok := values["Secret"]; ok {
+		t.Error("Hidden field should not be rendered. Got: ", values)
+	}
+	if values["Email"] != "adphi@example.com" {
+		t.Error("Email should be rendered to testuser:1. Got: ", values)
+	}
+
+	// Query results are filtered too
+	var results []map[string]interface{}
+	decodeJSON(do("GET", "/query/profile/"+url.QueryEscape(`{}`), "", userCookie).Body, &results)
+	if len(results) != 1 {
+		t.Fatal("Profile should be queried. Got: ", results)
+	}
+	if _, ok := results[0]["Email"]; ok {
+		t.Error("Email should not be queried. Got: ", results)
+	}
+
+	// Keys are matched without case, like encoding/json
+	if res := do("PUT", path, `{"level": 10}`, adminCookie); res.Code != 403 {
+		t.Error("Readonly field should not be written. Got: ", res.Code)
+	}
+	if res := do("POST", "/profile", `{"Name": "Bob", "Badge": "gold"}`, userCookie); res.Code != 403 {
+		t.Error("Badge should only be written by testuser:1. Got: ", res.Code)
+	}
+	if res := do("PUT", path, `{"Badge": "gold"}`, adminCookie); res.Code != 200 {
+		t.Error("Badge should be written by testuser:1. Got: ", res.Code)
+	}
+	if res := do("POST", "/profile", `{"Name": "Bob"}`, userCookie); res.Code != 200 {
+		t.Error("Public fields should be written. Got: ", res.Code)
+	}
+}
+
+func TestFieldPermissionsOrder(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.RegisterModel(&profile{}, AllACL())
+
+	_, adminCookie := registerUser(t, "admin")
+	_, userCookie := registerUser(t, "user")
+	g.db.Create(&profile{Name: "Adphi", Email: "secret@example.com"})
+
+	// Cursor would contain the emails
+	query := "/query/profile/" + url.QueryEscape(`{"limit": 1, "cursor": "", "order": {"email": false}}`)
+	if res := do("GET", query, "", userCookie); res.Code != 400 {
+		t.Error("User should not order by email. Got: ", res.Code, res.Body.String())
+	}
+	if res := do("GET", query, "", ""); res.Code != 400 {
+		t.Error("Anonymous user should not order by email. Got: ", res.Code)
+	}
+	if res := do("GET", query, "", adminCookie); res.Code != 200 {
+		t.Error("testuser:1 should order by email. Got: ", res.Code, res.Body.String())
+	}
+}
+
+func TestFieldPermissionsWhere(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	g.RegisterModel(&profile{}, AllACL())
+
+	_, adminCookie := registerUser(t, "admin")
+	_, userCookie := registerUser(t, "user")
+	g.db.Create(&profile{Name: "Adphi", Email: "secret@example.com"})
+
+	// Results would tell whether the guess is right
+	query := "/query/profile/" + url.QueryEscape(`{"where": [{"key": "email", "op": "=", "val": "secret@example.com"}]}`)
+	if res := do("GET", query, "", userCookie); res.Code != 400 {
+		t.Error("User should not filter on email. Got: ", res.Code, res.Body.String())
+	}
+	if res := do("GET", query, "", adminCookie); res.Code != 200 {
+		t.Error("testuser:1 should filter on email. Got: ", res.Code, res.Body.String())
+	}
+}
+
+func TestFieldPermissionsLiveWhere(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+	live.RegisterModel(&profile{}, AllACL())
+
+	where := `{"where": [{"key": "email", "op": "=", "val": "secret@example.com"}]}`
+	res, err := http.Get(server.URL + "/profile/events?query=" + url.QueryEscape(where))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Error("Event stream should not filter on email. Got: ", res.StatusCode)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/live", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]interface{}{"op": "subscribe", "id": "email", "table": "profile", "query": json.RawMessage(where)})
+	var msg map[string]interface{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["op"] != "error" || msg["id"] != "email" {
+		t.Error("Subscription should not filter on email. Got: ", msg)
+	}
+}
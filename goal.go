@@ -2,6 +2,7 @@ package goal
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -11,26 +12,35 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/sirupsen/logrus"
-	"gitlab.bertha.cloud/partitio/pqstream"
 	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type Goal struct {
 	ctx context.Context
 	c   *conf
 
-	db       *gorm.DB
-	cacher   Cacher
-	mux      *mux.Router
-	session  sessions.Store
-	streamer *pqstream.Streamer
+	db      *gorm.DB
+	cacher  Cacher
+	mux     *mux.Router
+	session sessions.Store
+	broker  Broker
+	live    *liveQueries
+	jwt     *jwtAuth
+	mailer  Mailer
 
-	resources map[reflect.Type]ResourceACL
-	userType  reflect.Type
+	attempts  *loginAttempts
+	passwords *passwordHashing
+
+	resources   map[reflect.Type]ResourceACL
+	policies    map[reflect.Type][]Policy
+	defaultACLs map[reflect.Type]DefaultACL
+	userType    reflect.Type
 }
 
 type conf struct {
@@ -39,16 +49,57 @@ type conf struct {
 	dbAddress   string
 	sessionName string
 	sessionKey  string
+
+	usernameColumn      string
+	passwordColumn      string
+	emailColumn         string
+	requireVerification bool
+	passwordPolicy      PasswordPolicy
+	totpIssuer          string
+
+	liveQueries   bool
+	liveQueryPath string
+	pqStream      bool
+	replaySize    int
+
+	shutdownTimeout time.Duration
+
+	certFile            string
+	keyFile             string
+	tlsConfig           *tls.Config
+	certificateProvider CertificateProvider
+	disableHTTP2        bool
+
+	adminRoles    []string
+	refreshExpiry time.Duration
+
+	skipMigration bool
+	clientIP      func(*http.Request) string
+}
+
+// CertificateProvider provides certificates for TLS handshakes, for example
+// from an ACME server. It is implemented by golang.org/x/crypto/acme/autocert.Manager
+type CertificateProvider interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
 }
 
 type Option func(*Goal) error
 
 func NewGoal(options ...Option) (*Goal, error) {
-	g := &Goal{resources: map[reflect.Type]ResourceACL{}, c: &conf{
+	g := &Goal{resources: map[reflect.Type]ResourceACL{}, attempts: newLoginAttempts(), passwords: newPasswordHashing(), c: &conf{
 		// sessionName is default name for user session
 		sessionName: "goal.UserSessionName",
 		// sessionKey is default key for user object
 		sessionKey: "goal.UserSessionKey",
+		// liveQueryPath is default path for live queries WebSocket
+		liveQueryPath: "/live",
+		// replaySize is default number of events kept per table
+		// to resume event streams
+		replaySize: 100,
+		// shutdownTimeout is default time to wait for in-flight requests
+		shutdownTimeout: 10 * time.Second,
+		// totpIssuer is default issuer shown by authenticator apps
+		totpIssuer: "goal",
 	}}
 
 	// Create router
@@ -61,6 +112,13 @@ func NewGoal(options ...Option) (*Goal, error) {
 			return nil, err
 		}
 	}
+
+	// Users could never verify their email without a mailer
+	if g.c.requireVerification && g.mailer == nil {
+		logrus.Error(ErrMailerRequired)
+		return nil, ErrMailerRequired
+	}
+
 	// Init context
 	g.ctx = BackgroundWithSignals(g.ctx)
 
@@ -74,22 +132,55 @@ func NewGoal(options ...Option) (*Goal, error) {
 		}
 	}
 
+	// Create goal tables
+	if !g.c.skipMigration {
+		if err := g.Migrate(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Cache records once the database is known
+	if g.cacher != nil {
+		g.registerCacher()
+	}
+
 	// Create session if not set
 	if g.session == nil {
 		g.session = sessions.NewCookieStore([]byte("you-should-set-the-key-yourself"))
 	}
 
+	// Session cookies must only be sent over TLS when it is enabled
+	if store, ok := g.session.(*sessions.CookieStore); ok && g.tlsEnabled() {
+		store.Options.Secure = true
+	}
+
+	// Start live queries
+	if g.c.liveQueries {
+		if err := g.startLiveQueries(); err != nil {
+			logrus.Error(err)
+			return nil, err
+		}
+	}
+
 	return g, nil
 }
 
+// Migrate creates or updates the goal tables, prefixed by "goal_", used
+// by permissions, roles, sessions, verification and TOTP
+func (g *Goal) Migrate() error {
+	tables := []interface{}{&classPermission{}, &Role{}, &roleInclude{}, &roleMember{}, &UserSession{},
+		&authToken{}, &emailVerification{}, &userTOTP{}, &recoveryCode{}}
+	return g.db.AutoMigrate(tables...).Error
+}
+
 func (g *Goal) Mux() *mux.Router {
 	return g.mux
 }
 
 func (g *Goal) Close() error {
 	var errs []string
-	if g.streamer != nil {
-		if err := g.streamer.Close(); err != nil {
+	if g.broker != nil {
+		if err := g.broker.Close(); err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
@@ -103,14 +194,60 @@ func (g *Goal) Close() error {
 			errs = append(errs, err.Error())
 		}
 	}
+	if g.attempts != nil {
+		g.attempts.memory.Close()
+	}
 	if len(errs) > 0 {
 		return errors.New(strings.Join(errs, ". "))
 	}
 	return nil
 }
 
+// Run serves the API until goal context is cancelled. The server then stops
+// accepting connections, waits for in-flight requests within the shutdown
+// timeout and closes goal
 func (g *Goal) Run() error {
-	return http.ListenAndServe(g.c.address, g.mux)
+	server := &http.Server{Addr: g.c.address, Handler: g.mux, TLSConfig: g.serverTLSConfig()}
+	if g.c.disableHTTP2 {
+		// A non nil map prevents the server from configuring HTTP/2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	if g.live != nil {
+		// Hijacked WebSocket connections are not tracked by the server
+		server.RegisterOnShutdown(g.live.close)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if g.tlsEnabled() {
+			// HTTP/2 is enabled by default over TLS
+			serveErr <- server.ListenAndServeTLS(g.c.certFile, g.c.keyFile)
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-g.ctx.Done():
+	}
+
+	logrus.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), g.c.shutdownTimeout)
+	defer cancel()
+
+	var errs []string
+	if err := server.Shutdown(ctx); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := g.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ". "))
+	}
+	return nil
 }
 
 func WithContext(ctx context.Context) Option {
@@ -118,18 +255,50 @@ func WithContext(ctx context.Context) Option {
 		if ctx == nil {
 			return ErrNilContext
 		}
-		goal.ctx = BackgroundWithSignals(ctx)
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					logrus.Info("Context cancelled")
-					logrus.Info("Shutting down")
+		goal.ctx = ctx
+		return nil
+	}
+}
+
+// tlsEnabled reports whether goal serves HTTPS
+func (g *Goal) tlsEnabled() bool {
+	return g.c.certFile != "" || g.c.tlsConfig != nil || g.c.certificateProvider != nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server, or nil
+// if certificate files are enough
+func (g *Goal) serverTLSConfig() *tls.Config {
+	if g.c.tlsConfig == nil && g.c.certificateProvider == nil {
+		return nil
+	}
+
+	config := &tls.Config{}
+	if g.c.tlsConfig != nil {
+		config = g.c.tlsConfig.Clone()
+	}
+	if g.c.certificateProvider != nil {
+		config.GetCertificate = g.c.certificateProvider.GetCertificate
+		// Providers such as autocert need their own protocols to answer challenges
+		if p, ok := g.c.certificateProvider.(interface{ TLSConfig() *tls.Config }); ok {
+			for _, proto := range p.TLSConfig().NextProtos {
+				if proto == "h2" && g.c.disableHTTP2 {
+					// Clients would negotiate HTTP/2, which is not served
+					continue
 				}
+				config.NextProtos = appendProto(config.NextProtos, proto)
 			}
-		}()
-		return nil
+		}
+	}
+	return config
+}
+
+func appendProto(protos []string, proto string) []string {
+	for _, p := range protos {
+		if p == proto {
+			return protos
+		}
 	}
+	return append(protos, proto)
 }
 
 func WithAddress(address string) Option {
@@ -139,12 +308,84 @@ func WithAddress(address string) Option {
 	}
 }
 
+// WithTLS serves HTTPS with the certificate and key files
+func WithTLS(certFile, keyFile string) Option {
+	return func(goal *Goal) error {
+		if certFile == "" || keyFile == "" {
+			return ErrEmptyTLSFiles
+		}
+		goal.c.certFile = certFile
+		goal.c.keyFile = keyFile
+		return nil
+	}
+}
+
+// WithTLSConfig serves HTTPS with config, which must provide the certificates
+// unless WithTLS or WithCertificateProvider is used
+func WithTLSConfig(config *tls.Config) Option {
+	return func(goal *Goal) error {
+		if config == nil {
+			return ErrNilTLSConfig
+		}
+		goal.c.tlsConfig = config
+		return nil
+	}
+}
+
+// WithCertificateProvider serves HTTPS with certificates retrieved
+// from provider during TLS handshakes
+func WithCertificateProvider(provider CertificateProvider) Option {
+	return func(goal *Goal) error {
+		if provider == nil {
+			return ErrNilCertificateProvider
+		}
+		goal.c.certificateProvider = provider
+		return nil
+	}
+}
+
+// WithClientIP sets how the address of the client is read from requests,
+// e.g from X-Forwarded-For behind a trusted proxy. The remote address of
+// the connection is used by default
+func WithClientIP(clientIP func(*http.Request) string) Option {
+	return func(goal *Goal) error {
+		goal.c.clientIP = clientIP
+		return nil
+	}
+}
+
+// WithoutMigration does not create the goal tables on start, for
+// databases migrated by other tools or with Migrate
+func WithoutMigration() Option {
+	return func(goal *Goal) error {
+		goal.c.skipMigration = true
+		return nil
+	}
+}
+
+// WithoutHTTP2 serves HTTPS with HTTP/1.1 only
+func WithoutHTTP2() Option {
+	return func(goal *Goal) error {
+		goal.c.disableHTTP2 = true
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets the time Run waits for in-flight requests
+// before closing goal
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(goal *Goal) error {
+		goal.c.shutdownTimeout = timeout
+		return nil
+	}
+}
+
 func WithCache(cache Cacher) Option {
 	return func(goal *Goal) error {
 		if cache == nil {
 			return ErrNilCache
 		}
-		goal.registerCacher(cache)
+		goal.cacher = cache
 		return nil
 	}
 }
@@ -175,8 +416,65 @@ func WithDBOptions(callback func(db *gorm.DB) error) Option {
 	}
 }
 
-func WithLiveQueries() Option {
+// WithLiveQueries allows clients to subscribe to changes matching a query
+// over WebSocket. The endpoint is served on "/live" unless another path is given.
+// Changes made through goal database are published to an in-process broker,
+// unless another broker is set
+func WithLiveQueries(path ...string) Option {
+	return func(goal *Goal) error {
+		goal.c.liveQueries = true
+		if len(path) > 0 && path[0] != "" {
+			goal.c.liveQueryPath = path[0]
+		}
+		return nil
+	}
+}
+
+// WithLiveQueryReplay sets the number of events kept per table, so that
+// event streams can resume with Last-Event-ID header
+func WithLiveQueryReplay(size int) Option {
+	return func(goal *Goal) error {
+		goal.c.replaySize = size
+		return nil
+	}
+}
+
+// WithLiveQueryBroker sets the broker delivering live queries events,
+// it enables live queries
+func WithLiveQueryBroker(broker Broker) Option {
+	return func(goal *Goal) error {
+		if broker == nil {
+			return ErrNilBroker
+		}
+		goal.c.liveQueries = true
+		goal.broker = broker
+		return nil
+	}
+}
+
+// WithPQStream uses postgres notifications as live queries events,
+// so changes made outside of goal are published. It enables live queries
+func WithPQStream() Option {
+	return func(goal *Goal) error {
+		goal.c.liveQueries = true
+		goal.c.pqStream = true
+		return nil
+	}
+}
+
+// WithAdminRoles sets the roles allowed to use administration paths
+func WithAdminRoles(roles ...string) Option {
+	return func(goal *Goal) error {
+		goal.c.adminRoles = roles
+		return nil
+	}
+}
+
+// WithRefreshExpiry sets the lifetime of refresh tokens, extended
+// every time they are used
+func WithRefreshExpiry(expiry time.Duration) Option {
 	return func(goal *Goal) error {
+		goal.c.refreshExpiry = expiry
 		return nil
 	}
 }
@@ -207,8 +505,9 @@ func WithSessionStore(keyPairs ...[]byte) Option {
 }
 
 // BackgroundWithSignals returns a Context that will be
-// canceled with the process receives a SIGINT signal.
-// This function starts a goroutine and listens for signals.
+// canceled with the process receives a SIGINT or SIGTERM signal.
+// This function starts a goroutine and listens for signals
+// until the context is done.
 func BackgroundWithSignals(p context.Context) context.Context {
 	if p == nil {
 		p = context.Background()
@@ -216,10 +515,14 @@ func BackgroundWithSignals(p context.Context) context.Context {
 	ctx, cancel := context.WithCancel(p)
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		signal.Reset(os.Interrupt)
-		cancel()
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(c)
+		select {
+		case <-c:
+			logrus.Info("Signal received")
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 	return ctx
 }
@@ -0,0 +1,193 @@
+package goal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// freeAddress returns a local address available to listen on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestRunGracefulShutdown(t *testing.T) {
+	address := freeAddress(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server, err := NewGoal(
+		WithContext(ctx),
+		WithAddress(address),
+		WithDBAddress("sqlite3", ":memory:"),
+		WithShutdownTimeout(5*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server.Mux().HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Run()
+	}()
+
+	// Wait for the server to listen
+	var res *http.Response
+	responses := make(chan *http.Response, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			res, err := http.Get("http://" + address + "/slow")
+			if err == nil {
+				responses <- res
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		responses <- nil
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server did not start")
+	}
+
+	// Cancel while the request is in-flight
+	cancel()
+
+	res = <-responses
+	if res == nil {
+		t.Fatal("In-flight request should succeed")
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "done" {
+		t.Error("In-flight request should be drained, got: ", string(body))
+	}
+
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run should return after context cancellation")
+	}
+
+	// Goal is closed
+	if err = server.db.DB().Ping(); err == nil {
+		t.Error("Database should be closed after shutdown")
+	}
+}
+
+func TestRunTLS(t *testing.T) {
+	// Reuse httptest certificate, trusted by its client
+	ts := httptest.NewUnstartedServer(nil)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	address := freeAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := NewGoal(
+		WithContext(ctx),
+		WithAddress(address),
+		WithDBAddress("sqlite3", ":memory:"),
+		WithSessionStore([]byte("something-very-secret")),
+		WithTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store := server.session.(*sessions.CookieStore); !store.Options.Secure {
+		t.Error("Session cookies should be secure with TLS")
+	}
+
+	server.Mux().HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	})
+	go server.Run()
+
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		res, err = ts.Client().Get("https://" + address + "/ping")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.ProtoMajor != 2 {
+		t.Error("Server should serve HTTP/2 over TLS, got: ", res.Proto)
+	}
+}
+
+// autocertProvider offers protocols like autocert.Manager
+type autocertProvider struct{}
+
+func (p autocertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return nil, nil
+}
+
+func (p autocertProvider) TLSConfig() *tls.Config {
+	return &tls.Config{NextProtos: []string{"h2", "http/1.1", "acme-tls/1"}}
+}
+
+func TestCertificateProviderProtocols(t *testing.T) {
+	for _, disableHTTP2 := range []bool{false, true} {
+		server := &Goal{c: &conf{certificateProvider: autocertProvider{}, disableHTTP2: disableHTTP2}}
+
+		protos := server.serverTLSConfig().NextProtos
+		expected := []string{"h2", "http/1.1", "acme-tls/1"}
+		if disableHTTP2 {
+			expected = expected[1:]
+		}
+		if fmt.Sprint(protos) != fmt.Sprint(expected) {
+			t.Error("Server should offer ", expected, ", got: ", protos)
+		}
+	}
+}
+
+func TestWithoutMigration(t *testing.T) {
+	server, err := NewGoal(WithDBAddress("sqlite3", ":memory:"), WithoutMigration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if server.db.HasTable(&Role{}) {
+		t.Error("Goal tables should not be created")
+	}
+	if err = server.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !server.db.HasTable(&Role{}) || !server.db.HasTable(&recoveryCode{}) {
+		t.Error("Goal tables should be created by Migrate")
+	}
+}
@@ -0,0 +1,201 @@
+// jwt issues signed access tokens when users register or login, and
+// accepts them on every request with the Authorization header:
+// Authorization: Bearer <token>
+// Cookie sessions keep working alongside tokens.
+
+package goal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// AccessTokenHeader is the response header containing the access
+// token of the user after register and login
+const AccessTokenHeader = "X-Access-Token"
+
+// JWTKey signs and verifies access tokens
+type JWTKey struct {
+	// ID is sent in the "kid" header of the tokens
+	ID string
+	// Method is the signing method, e.g jwt.SigningMethodHS256,
+	// jwt.SigningMethodRS256 or jwt.SigningMethodES256
+	Method jwt.SigningMethod
+	// SignKey is a []byte for HMAC, a *rsa.PrivateKey for RSA
+	// and a *ecdsa.PrivateKey for ECDSA
+	SignKey interface{}
+	// VerifyKey is a []byte for HMAC, a *rsa.PublicKey for RSA
+	// and a *ecdsa.PublicKey for ECDSA
+	VerifyKey interface{}
+}
+
+// JWTConfig configures access tokens
+type JWTConfig struct {
+	// Keys verify the tokens, the first one signs new tokens.
+	// Previous keys are kept to accept tokens issued before a rotation
+	Keys []JWTKey
+	// Expiry is the lifetime of the tokens, 15 minutes by default
+	Expiry time.Duration
+	// Issuer is set and checked in the "iss" claim if not empty
+	Issuer string
+}
+
+var (
+	ErrEmptyJWTKeys   = errors.New("jwt keys cannot be empty")
+	ErrInvalidJWTKey  = errors.New("jwt key must have an id, a method and a verify key")
+	ErrInvalidToken   = errors.New("invalid access token")
+	ErrUnknownTokenID = errors.New("unknown access token key")
+)
+
+// defaultJWTExpiry is the default lifetime of access tokens
+const defaultJWTExpiry = 15 * time.Minute
+
+// accessClaims are the claims of access tokens, they are bound to
+// a server side session so they can be revoked
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid"`
+}
+
+// jwtAuth issues and verifies access tokens
+type jwtAuth struct {
+	mu     sync.RWMutex
+	keys   []JWTKey
+	expiry time.Duration
+	issuer string
+}
+
+func validateJWTKeys(keys []JWTKey) error {
+	if len(keys) == 0 {
+		return ErrEmptyJWTKeys
+	}
+	for _, key := range keys {
+		if key.ID == "" || key.Method == nil || key.VerifyKey == nil {
+			return ErrInvalidJWTKey
+		}
+	}
+	// New tokens are signed with the first key
+	if keys[0].SignKey == nil {
+		return ErrInvalidJWTKey
+	}
+	return nil
+}
+
+// WithJWT issues access tokens on register and login, and authenticates
+// requests with a bearer token
+func WithJWT(config JWTConfig) Option {
+	return func(goal *Goal) error {
+		if err := validateJWTKeys(config.Keys); err != nil {
+			return err
+		}
+		expiry := config.Expiry
+		if expiry <= 0 {
+			expiry = defaultJWTExpiry
+		}
+		goal.jwt = &jwtAuth{keys: config.Keys, expiry: expiry, issuer: config.Issuer}
+		return nil
+	}
+}
+
+// RotateJWTKeys replaces the keys of access tokens, the first one signs
+// new tokens. Tokens signed by removed keys are no longer accepted
+func (g *Goal) RotateJWTKeys(keys ...JWTKey) error {
+	if g.jwt == nil {
+		return ErrEmptyJWTKeys
+	}
+	if err := validateJWTKeys(keys); err != nil {
+		return err
+	}
+
+	g.jwt.mu.Lock()
+	defer g.jwt.mu.Unlock()
+	g.jwt.keys = keys
+	return nil
+}
+
+// issue returns a signed access token for the user id and session
+func (j *jwtAuth) issue(userID interface{}, sessionID string) (string, time.Time, error) {
+	j.mu.RLock()
+	key := j.keys[0]
+	j.mu.RUnlock()
+
+	now := time.Now()
+	expiresAt := now.Add(j.expiry)
+	claims := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   fmt.Sprint(userID),
+			Issuer:    j.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		SessionID: sessionID,
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.SignKey)
+	return signed, expiresAt, err
+}
+
+// verify returns the claims of a valid access token
+func (j *jwtAuth) verify(tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		j.mu.RLock()
+		defer j.mu.RUnlock()
+
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range j.keys {
+			if key.ID != kid {
+				continue
+			}
+			// Token must be signed with the method of the key
+			if token.Method.Alg() != key.Method.Alg() {
+				return nil, ErrInvalidToken
+			}
+			return key.VerifyKey, nil
+		}
+		return nil, ErrUnknownTokenID
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	if j.issuer != "" && !claims.VerifyIssuer(j.issuer, true) {
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.SessionID == "" || claims.ExpiresAt == nil {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token of the Authorization header, or
+// an empty string
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// setAccessToken sends a new access token for the session in the response
+func (g *Goal) setAccessToken(w http.ResponseWriter, session *UserSession) error {
+	if g.jwt == nil {
+		return nil
+	}
+
+	token, _, err := g.jwt.issue(session.UserID, session.ID)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(AccessTokenHeader, token)
+	return nil
+}
@@ -0,0 +1,85 @@
+package goal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// doBearer serves a request with the access token and returns the status code
+func doBearer(method string, path string, token string) int {
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	g.mux.ServeHTTP(res, req)
+	return res.Code
+}
+
+func TestJWT(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	hmacKey := JWTKey{ID: "hmac", Method: jwt.SigningMethodHS256, SignKey: []byte("secret"), VerifyKey: []byte("secret")}
+	if err := WithJWT(JWTConfig{Keys: []JWTKey{hmacKey}, Issuer: "goal"})(g); err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := registerUser(t, "Adphi")
+
+	art := &article{Title: "Private"}
+	art.Permission = Permission{Read: `["testuser:1"]`}
+	g.db.Create(art)
+	path := fmt.Sprint("/article/", art.ID)
+
+	res := do("POST", "/auth/login", `{"username":"Adphi", "password": "something-secret"}`, "")
+	token := res.Header().Get(AccessTokenHeader)
+	if res.Code != 200 || token == "" {
+		t.Fatal("Login should issue an access token. Got: ", res.Code, res.Header())
+	}
+
+	if code := doBearer("GET", path, token); code != 200 {
+		t.Error("Bearer token should authenticate user. Got: ", code)
+	}
+	if code := doBearer("GET", path, token+"x"); code != 403 {
+		t.Error("Tampered token should be rejected. Got: ", code)
+	}
+
+	expired, _, _ := (&jwtAuth{keys: []JWTKey{hmacKey}, expiry: -time.Minute, issuer: "goal"}).issue(user.ID, "unknown")
+	if code := doBearer("GET", path, expired); code != 403 {
+		t.Error("Expired token should be rejected. Got: ", code)
+	}
+
+	// Token signed with none algorithm
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.RegisteredClaims{Subject: "1"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if code := doBearer("GET", path, unsigned); code != 403 {
+		t.Error("Unsigned token should be rejected. Got: ", code)
+	}
+
+	// Previous tokens are accepted while the previous key is kept
+	private, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecKey := JWTKey{ID: "ec", Method: jwt.SigningMethodES256, SignKey: private, VerifyKey: &private.PublicKey}
+	if err := g.RotateJWTKeys(ecKey, hmacKey); err != nil {
+		t.Fatal(err)
+	}
+	if code := doBearer("GET", path, token); code != 200 {
+		t.Error("Token signed by previous key should be accepted. Got: ", code)
+	}
+
+	res = do("POST", "/auth/login", `{"username":"Adphi", "password": "something-secret"}`, "")
+	ecToken := res.Header().Get(AccessTokenHeader)
+	if code := doBearer("GET", path, ecToken); code != 200 {
+		t.Error("Token signed by new key should be accepted. Got: ", code)
+	}
+
+	g.RotateJWTKeys(ecKey)
+	if code := doBearer("GET", path, token); code != 403 {
+		t.Error("Token signed by removed key should be rejected. Got: ", code)
+	}
+}
@@ -0,0 +1,400 @@
+// livequery pushes database changes to clients subscribed
+// with a query over WebSocket. A subscription message looks like:
+// {
+//   "op": "subscribe",
+//   "id": "1",
+//   "table": "article",
+//   "query": {"where":[{"key": "title", "op": "like", "val": "%news%"}]}
+// }
+
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// LiveEventType defines which change happened on a record
+type LiveEventType string
+
+const (
+	LiveCreate LiveEventType = "create"
+	LiveUpdate LiveEventType = "update"
+	LiveDelete LiveEventType = "delete"
+)
+
+// LiveEvent is a change on a record of a registered model
+type LiveEvent struct {
+	Type   LiveEventType
+	Table  string
+	Object interface{}
+}
+
+// liveMessage is exchanged with the client over the WebSocket connection.
+// Client sends "subscribe" and "unsubscribe", server answers with
+// "subscribed", "unsubscribed", "error" or the type of the event
+type liveMessage struct {
+	Op     string          `json:"op"`
+	ID     string          `json:"id"`
+	Table  string          `json:"table,omitempty"`
+	Query  json.RawMessage `json:"query,omitempty"`
+	Object interface{}     `json:"object,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+const (
+	liveSubscribe    = "subscribe"
+	liveSubscribed   = "subscribed"
+	liveUnsubscribe  = "unsubscribe"
+	liveUnsubscribed = "unsubscribed"
+	liveError        = "error"
+
+	// liveWriteWait is the time allowed to write a message to the client
+	liveWriteWait = 10 * time.Second
+	// liveSendBuffer is the number of messages waiting to be sent to a client
+	// before it is considered too slow and disconnected
+	liveSendBuffer = 64
+)
+
+var (
+	ErrLiveQueryNotAllowed = errors.New("live queries are not allowed on this table")
+	ErrUnknownLiveOp       = errors.New("unknown operation")
+)
+
+// liveSubscription is a query registered by a client
+type liveSubscription struct {
+	id     string
+	table  string
+	params *queryParams
+}
+
+// liveClient is a WebSocket connection with its subscriptions
+type liveClient struct {
+	conn    *websocket.Conn
+	request *http.Request
+	send    chan *liveMessage
+	// done is closed with the connection, senders must not block after
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.RWMutex
+	subs map[string]*liveSubscription
+}
+
+// close closes the connection and stops the senders
+func (c *liveClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// subscriptions returns a copy of the subscriptions of the client
+func (c *liveClient) subscriptions() []*liveSubscription {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	subs := make([]*liveSubscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// liveQueries dispatches events to subscribed clients
+type liveQueries struct {
+	g        *Goal
+	upgrader websocket.Upgrader
+
+	mu      sync.RWMutex
+	clients map[*liveClient]struct{}
+	streams map[*eventStream]struct{}
+
+	// seq is the id of the last event, history keeps the
+	// last events of each table to be replayed
+	seq     uint64
+	history map[string][]*liveRecord
+}
+
+func newLiveQueries(g *Goal) *liveQueries {
+	return &liveQueries{
+		g:       g,
+		clients: map[*liveClient]struct{}{},
+		streams: map[*eventStream]struct{}{},
+		history: map[string][]*liveRecord{},
+	}
+}
+
+// startLiveQueries initializes live queries subsystem and listens to the
+// broker change events
+func (g *Goal) startLiveQueries() error {
+	if g.broker == nil {
+		if g.c.pqStream {
+			broker, err := newPQStreamBroker(g)
+			if err != nil {
+				return err
+			}
+			g.broker = broker
+		} else {
+			g.broker = NewMemoryBroker()
+		}
+	}
+	g.registerBrokerCallbacks()
+
+	events, err := g.broker.Subscribe(g.ctx)
+	if err != nil {
+		return err
+	}
+
+	g.live = newLiveQueries(g)
+	g.AddLiveQueryPath(g.c.liveQueryPath)
+
+	go func() {
+		for event := range events {
+			g.live.dispatch(event)
+		}
+	}()
+	return nil
+}
+
+// dispatch records the event for replay, and sends it to every subscription
+// matching the record and which the client is allowed to read. Access is
+// checked outside the lock, as it may query the database
+func (l *liveQueries) dispatch(event *LiveEvent) {
+	l.mu.Lock()
+	l.seq++
+	record := &liveRecord{id: l.seq, event: event}
+	l.remember(record)
+
+	clients := make([]*liveClient, 0, len(l.clients))
+	for client := range l.clients {
+		clients = append(clients, client)
+	}
+	streams := make([]*eventStream, 0, len(l.streams))
+	for stream := range l.streams {
+		streams = append(streams, stream)
+	}
+	l.mu.Unlock()
+
+	for _, client := range clients {
+		for _, sub := range client.subscriptions() {
+			if !l.allowed(sub.table, sub.params, client.request, event) {
+				continue
+			}
+
+			object, err := l.g.filterFields(client.request, event.Object)
+			if err != nil {
+				logrus.Errorf("Live query: %v", err)
+				continue
+			}
+
+			msg := &liveMessage{Op: string(event.Type), ID: sub.id, Object: object}
+			select {
+			case client.send <- msg:
+			case <-client.done:
+			default:
+				logrus.Warn("Live query client is too slow, closing connection")
+				client.close()
+			}
+		}
+	}
+
+	for _, stream := range streams {
+		if !l.allowed(stream.table, stream.params, stream.request, event) {
+			continue
+		}
+
+		select {
+		case stream.send <- record:
+		case <-stream.done:
+		default:
+			// Client will resume from its last event id
+			logrus.Warn("Event stream client is too slow, closing stream")
+			stream.close()
+		}
+	}
+}
+
+// allowed checks if the event matches the query and if the
+// client can read the resource
+func (l *liveQueries) allowed(table string, params *queryParams, request *http.Request, event *LiveEvent) bool {
+	if table != event.Table {
+		return false
+	}
+
+	ok, err := params.Match(event.Object)
+	if err != nil || !ok {
+		return false
+	}
+
+	if !l.g.matchPolicies(event.Object, request) {
+		return false
+	}
+
+	return l.g.CanPerform(event.Object, request, true) == nil
+}
+
+func (l *liveQueries) handler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, request *http.Request) {
+		conn, err := l.upgrader.Upgrade(rw, request, nil)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+
+		client := &liveClient{
+			conn:    conn,
+			request: request,
+			send:    make(chan *liveMessage, liveSendBuffer),
+			done:    make(chan struct{}),
+			subs:    map[string]*liveSubscription{},
+		}
+
+		l.mu.Lock()
+		l.clients[client] = struct{}{}
+		l.mu.Unlock()
+
+		go client.writeLoop()
+		l.readLoop(client)
+
+		l.mu.Lock()
+		delete(l.clients, client)
+		l.mu.Unlock()
+		client.close()
+	}
+}
+
+// close closes all WebSocket connections
+func (l *liveQueries) close() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for client := range l.clients {
+		client.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(liveWriteWait),
+		)
+		client.close()
+	}
+}
+
+// readLoop handles client messages until the connection is closed
+func (l *liveQueries) readLoop(client *liveClient) {
+	defer client.close()
+
+	for {
+		msg := &liveMessage{}
+		if err := client.conn.ReadJSON(msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logrus.Debugf("Live query connection closed: %v", err)
+			}
+			return
+		}
+
+		var reply *liveMessage
+		switch msg.Op {
+		case liveSubscribe:
+			reply = l.subscribe(client, msg)
+		case liveUnsubscribe:
+			client.mu.Lock()
+			delete(client.subs, msg.ID)
+			client.mu.Unlock()
+			reply = &liveMessage{Op: liveUnsubscribed, ID: msg.ID}
+		default:
+			reply = &liveMessage{Op: liveError, ID: msg.ID, Error: ErrUnknownLiveOp.Error()}
+		}
+
+		select {
+		case client.send <- reply:
+		case <-client.done:
+			return
+		case <-l.g.ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribe validates the query and registers it for the client
+func (l *liveQueries) subscribe(client *liveClient, msg *liveMessage) *liveMessage {
+	fail := func(err error) *liveMessage {
+		return &liveMessage{Op: liveError, ID: msg.ID, Error: err.Error()}
+	}
+
+	if msg.ID == "" {
+		return fail(errors.New("subscription id is required"))
+	}
+
+	params, err := l.queryParams(msg.Table, msg.Query, client.request)
+	if err != nil {
+		return fail(err)
+	}
+
+	client.mu.Lock()
+	client.subs[msg.ID] = &liveSubscription{
+		id:     msg.ID,
+		table:  msg.Table,
+		params: params,
+	}
+	client.mu.Unlock()
+
+	return &liveMessage{Op: liveSubscribed, ID: msg.ID}
+}
+
+// queryParams parses and validates the query of a subscription on table
+func (l *liveQueries) queryParams(table string, query []byte, request *http.Request) (*queryParams, error) {
+	rType, ok := l.g.resourceType(table)
+	if !ok {
+		return nil, ErrLiveQueryNotAllowed
+	}
+	permissions, _, err := l.g.classPermissions(rType)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.g.checkPermit(request, permissions[ActionQuery]); err != nil {
+		return nil, ErrLiveQueryNotAllowed
+	}
+
+	params := l.g.requestQueryParams(request)
+	if len(query) > 0 {
+		if err := json.Unmarshal(query, params); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate the query against the model before accepting it
+	if _, err := params.Match(newObjectWithType(rType)); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// writeLoop sends messages to the client until the connection is closed
+func (c *liveClient) writeLoop() {
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// AddLiveQueryPath exposes live queries WebSocket endpoint on path
+func (g *Goal) AddLiveQueryPath(path string) {
+	if g.live == nil {
+		return
+	}
+	g.mux.Handle(path, g.live.handler())
+}
@@ -0,0 +1,271 @@
+package goal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
+)
+
+func TestPQStreamUnsupportedDB(t *testing.T) {
+	_, err := NewGoal(WithDBAddress("sqlite3", ":memory:"), WithPQStream())
+	if err != ErrLiveQueryUnsupportedDB {
+		t.Error("PQStream should not be supported with sqlite, got: ", err)
+	}
+}
+
+// setupLive creates a goal with live queries enabled
+func setupLive(t *testing.T) (*Goal, *httptest.Server) {
+	live, err := NewGoal(
+		WithDBAddress("sqlite3", ":memory:"),
+		WithDBOptions(func(db *gorm.DB) error {
+			db.SingularTable(true)
+			return nil
+		}),
+		WithLiveQueries(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live.RegisterModel(&testuser{}, AllACL())
+	return live, httptest.NewServer(live.Mux())
+}
+
+func TestLiveQueries(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/live"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	subscribe := map[string]interface{}{
+		"op":    "subscribe",
+		"id":    "thomas",
+		"table": "testuser",
+		"query": map[string]interface{}{
+			"where": []map[string]interface{}{{"key": "name", "op": "=", "val": "Thomas"}},
+		},
+	}
+	if err = conn.WriteJSON(subscribe); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg map[string]interface{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["op"] != "subscribed" || msg["id"] != "thomas" {
+		t.Fatal("Subscription should succeed, got: ", msg)
+	}
+
+	// Invalid queries are rejected
+	conn.WriteJSON(map[string]interface{}{"op": "subscribe", "id": "invalid", "table": "unknown"})
+	msg = nil
+	conn.ReadJSON(&msg)
+	if msg["op"] != "error" || msg["id"] != "invalid" {
+		t.Fatal("Subscription should fail, got: ", msg)
+	}
+
+	// Only matching records are sent
+	live.db.Create(&testuser{Name: "Alan"})
+	user := &testuser{Name: "Thomas", Age: 28}
+	live.db.Create(user)
+
+	msg = nil
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	object, _ := msg["object"].(map[string]interface{})
+	if msg["op"] != "create" || msg["id"] != "thomas" || object["Name"] != "Thomas" {
+		t.Error("Should receive creation of Thomas, got: ", msg)
+	}
+
+	live.db.Delete(user)
+
+	msg = nil
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["op"] != "delete" || msg["id"] != "thomas" {
+		t.Error("Should receive deletion of Thomas, got: ", msg)
+	}
+}
+
+func TestLiveQueriesHiddenFields(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+	live.SetUserModel(&testuser{})
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/live"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Events would tell which users match a password hash
+	conn.WriteJSON(map[string]interface{}{
+		"op":    "subscribe",
+		"id":    "password",
+		"table": "testuser",
+		"query": map[string]interface{}{
+			"where": []map[string]interface{}{{"key": "password", "op": "like", "val": "$2a$%"}},
+		},
+	})
+
+	var msg map[string]interface{}
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["op"] != "error" || msg["id"] != "password" {
+		t.Error("Subscription on password should fail, got: ", msg)
+	}
+}
+
+func TestLiveQueriesRollback(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := live.broker.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fails after the record is inserted, so the transaction is rolled back
+	live.db.Callback().Create().After("gorm:after_create").Before("gorm:commit_or_rollback_transaction").
+		Register("test:fail_create", func(scope *gorm.Scope) {
+			if user, ok := scope.Value.(*testuser); ok && user.Name == "Rollback" {
+				scope.Err(errors.New("rollback"))
+			}
+		})
+
+	live.db.Create(&testuser{Name: "Rollback"})
+	live.db.Create(&testuser{Name: "Thomas"})
+
+	select {
+	case event := <-events:
+		if user, ok := event.Object.(*testuser); !ok || user.Name != "Thomas" {
+			t.Error("Rolled back record should not be published, got: ", event.Object)
+		}
+	case <-time.After(time.Second):
+		t.Error("Committed record should be published")
+	}
+}
+
+func TestLiveQueriesCallerTransaction(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := live.broker.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Statements of the transaction are published before it is rolled back
+	tx := live.db.Begin()
+	tx.Create(&testuser{Name: "Rollback"})
+	tx.Rollback()
+
+	select {
+	case event := <-events:
+		if user, ok := event.Object.(*testuser); !ok || user.Name != "Rollback" {
+			t.Error("Record of the transaction should be published, got: ", event.Object)
+		}
+	case <-time.After(time.Second):
+		t.Error("Record of the transaction should be published")
+	}
+
+	var count int
+	live.db.Model(&testuser{}).Count(&count)
+	if count != 0 {
+		t.Error("Transaction should be rolled back, got: ", count)
+	}
+}
+
+func TestLiveQueriesRegisteredModels(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := live.broker.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Goal tables and models which are not registered are never published
+	live.db.AutoMigrate(&article{})
+	live.db.Create(&article{Title: "Unregistered"})
+	live.db.Create(&UserSession{ID: "session", TokenHash: "hash"})
+	live.db.Create(&testuser{Name: "Thomas"})
+
+	select {
+	case event := <-events:
+		if event.Table != "testuser" {
+			t.Error("Only registered models should be published, got: ", event.Table)
+		}
+	case <-time.After(time.Second):
+		t.Error("Registered model should be published")
+	}
+}
+
+func TestLiveQueriesClose(t *testing.T) {
+	live, server := setupLive(t)
+	defer live.Close()
+	defer server.Close()
+
+	// Client without read loop, which would close it as well
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer ws.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ws.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := &liveClient{conn: <-conns, done: make(chan struct{})}
+	live.live.mu.Lock()
+	live.live.clients[client] = struct{}{}
+	live.live.mu.Unlock()
+
+	// Writers of the client stop with the connection
+	live.live.close()
+	select {
+	case <-client.done:
+	default:
+		t.Error("Client should be done after close")
+	}
+	if _, _, err = conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Error("Client should receive a close message, got: ", err)
+	}
+}
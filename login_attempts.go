@@ -0,0 +1,164 @@
+// login_attempts counts the failed logins of each username and client
+// address. Once a limit is reached, logins are refused until the
+// lockout ends, even with the right password
+
+package goal
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LoginLimits configures the lockout of failed logins
+type LoginLimits struct {
+	// Attempts is the number of failed logins of an username before
+	// it is locked out, 5 by default
+	Attempts int
+	// IPAttempts is the number of failed logins from an address
+	// before it is locked out, 20 by default
+	IPAttempts int
+	// Lockout is how long logins are refused, and how long failures
+	// are remembered, 15 minutes by default
+	Lockout time.Duration
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrTooManyAttempts    = errors.New("too many failed login attempts")
+)
+
+// defaultLoginLimits are used unless WithLoginLimits is set
+var defaultLoginLimits = LoginLimits{Attempts: 5, IPAttempts: 20, Lockout: 15 * time.Minute}
+
+// loginFailures is the cached counter of failed logins
+type loginFailures struct {
+	Count       int       `json:"count"`
+	LastAt      time.Time `json:"last_at"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// loginAttempts keeps the counters in cacher of goal, or in memory
+// if there is none
+type loginAttempts struct {
+	mu     sync.Mutex
+	limits LoginLimits
+	memory Cacher
+}
+
+func newLoginAttempts() *loginAttempts {
+	return &loginAttempts{limits: defaultLoginLimits, memory: NewMemoryCache()}
+}
+
+// WithLoginLimits sets the number of failed logins before a lockout.
+// Zero fields keep their default value
+func WithLoginLimits(limits LoginLimits) Option {
+	return func(goal *Goal) error {
+		if limits.Attempts < 0 || limits.IPAttempts < 0 || limits.Lockout < 0 {
+			return errors.New("login limits cannot be negative")
+		}
+		if limits.Attempts == 0 {
+			limits.Attempts = defaultLoginLimits.Attempts
+		}
+		if limits.IPAttempts == 0 {
+			limits.IPAttempts = defaultLoginLimits.IPAttempts
+		}
+		if limits.Lockout == 0 {
+			limits.Lockout = defaultLoginLimits.Lockout
+		}
+		goal.attempts.limits = limits
+		return nil
+	}
+}
+
+// attemptsCacher returns the cacher of the counters
+func (g *Goal) attemptsCacher() Cacher {
+	if g.cacher != nil {
+		return g.cacher
+	}
+	return g.attempts.memory
+}
+
+// attemptKeys returns the counter keys of the username and address
+func (g *Goal) attemptKeys(username string, request *http.Request) (string, string) {
+	return defaultCacheKey("goal_login:user", strings.ToLower(username)),
+		defaultCacheKey("goal_login:ip", g.clientIP(request))
+}
+
+// lockedUntil returns the end of the lockout of the login, or zero
+func (g *Goal) lockedUntil(username string, request *http.Request) time.Time {
+	userKey, ipKey := g.attemptKeys(username, request)
+	now := time.Now()
+
+	var until time.Time
+	for _, key := range []string{userKey, ipKey} {
+		var failures loginFailures
+		if err := g.attemptsCacher().Get(key, &failures); err != nil {
+			continue
+		}
+		if failures.LockedUntil.After(now) && failures.LockedUntil.After(until) {
+			until = failures.LockedUntil
+		}
+	}
+	return until
+}
+
+// loginFailed counts a failed login of the username from the address
+func (g *Goal) loginFailed(username string, request *http.Request) {
+	userKey, ipKey := g.attemptKeys(username, request)
+	g.countFailure(userKey, g.attempts.limits.Attempts)
+	g.countFailure(ipKey, g.attempts.limits.IPAttempts)
+}
+
+// countFailure increments the counter of key, and locks it out
+// once it reaches the limit
+func (g *Goal) countFailure(key string, limit int) {
+	g.attempts.mu.Lock()
+	defer g.attempts.mu.Unlock()
+
+	cacher := g.attemptsCacher()
+	now := time.Now()
+	lockout := g.attempts.limits.Lockout
+
+	var failures loginFailures
+	if err := cacher.Get(key, &failures); err != nil || now.Sub(failures.LastAt) > lockout {
+		// Forget old failures
+		failures = loginFailures{}
+	}
+	failures.Count++
+	failures.LastAt = now
+	if failures.Count >= limit {
+		failures.Count = 0
+		failures.LockedUntil = now.Add(lockout)
+	}
+	// Failures are forgotten and lockouts end after the lockout duration
+	if err := setWithTTL(cacher, key, failures, lockout); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// loginSucceeded resets the counter of the username
+func (g *Goal) loginSucceeded(username string, request *http.Request) {
+	userKey, _ := g.attemptKeys(username, request)
+	if err := g.attemptsCacher().Delete(userKey); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// setRetryAfter tells the client when the lockout ends
+func setRetryAfter(w http.ResponseWriter, until time.Time) {
+	seconds := math.Ceil(time.Until(until).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+}
+
+// ResetLoginAttempts unlocks the username, e.g after an administrator
+// checked the account
+func (g *Goal) ResetLoginAttempts(username string) error {
+	return g.attemptsCacher().Delete(defaultCacheKey("goal_login:user", strings.ToLower(username)))
+}
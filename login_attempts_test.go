@@ -0,0 +1,115 @@
+package goal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginLockout(t *testing.T) {
+	ng, serve := setupAccounts(t, WithLoginLimits(LoginLimits{Attempts: 3, IPAttempts: 5, Lockout: time.Minute}))
+	defer ng.Close()
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	if res := serve("POST", "/auth/register", body, ""); res.Code != 200 {
+		t.Fatal("User should be registered. Got: ", res.Code)
+	}
+
+	// Unknown usernames and wrong passwords cannot be told apart
+	unknown := serve("POST", "/auth/login", `{"email": "nobody@example.com", "secret": "wrong"}`, "")
+	wrong := `{"email": "adphi@example.com", "secret": "wrong"}`
+	res := serve("POST", "/auth/login", wrong, "")
+	if unknown.Code != 401 || res.Code != 401 || unknown.Body.String() != res.Body.String() {
+		t.Error("Login failures should be the same. Got: ", unknown.Code, unknown.Body.String(), res.Code, res.Body.String())
+	}
+
+	for i := 0; i < 2; i++ {
+		serve("POST", "/auth/login", wrong, "")
+	}
+	res = serve("POST", "/auth/login", body, "")
+	if res.Code != 429 || res.Header().Get("Retry-After") == "" {
+		t.Fatal("Username should be locked out. Got: ", res.Code, res.Header())
+	}
+
+	if err := ng.ResetLoginAttempts("adphi@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 200 {
+		t.Fatal("Username should be unlocked. Got: ", res.Code)
+	}
+
+	// Fifth failure from the same address locks it out for all usernames
+	serve("POST", "/auth/login", `{"email": "other@example.com", "secret": "wrong"}`, "")
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 429 {
+		t.Error("Address should be locked out. Got: ", res.Code)
+	}
+}
+
+func TestLoginLockoutClientIP(t *testing.T) {
+	ng, serve := setupAccounts(t,
+		WithLoginLimits(LoginLimits{Attempts: 10, IPAttempts: 2, Lockout: time.Minute}),
+		WithClientIP(func(r *http.Request) string { return r.Header.Get("X-Real-IP") }),
+	)
+	defer ng.Close()
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	if res := serve("POST", "/auth/register", body, ""); res.Code != 200 {
+		t.Fatal("User should be registered. Got: ", res.Code)
+	}
+
+	// Clients behind the same proxy are counted apart
+	login := func(ip string, body string) int {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(body))
+		req.Header.Set("X-Real-IP", ip)
+		ng.mux.ServeHTTP(res, req)
+		return res.Code
+	}
+	for i := 0; i < 2; i++ {
+		login("10.0.0.1", `{"email": "other@example.com", "secret": "wrong"}`)
+	}
+	if code := login("10.0.0.1", body); code != 429 {
+		t.Error("Address should be locked out. Got: ", code)
+	}
+	if code := login("10.0.0.2", body); code != 200 {
+		t.Error("Other address should not be locked out. Got: ", code)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	cache := NewMemoryCache()
+	if err := cache.Set("key", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var val map[string]int
+	if err := cache.Get("key", &val); err != nil || val["a"] != 1 {
+		t.Error("Value should be cached. Got: ", val, err)
+	}
+
+	cache.Delete("key")
+	if exists, _ := cache.Exists("key"); exists {
+		t.Error("Key should be deleted")
+	}
+	if err := cache.Get("key", &val); err != ErrCacheMiss {
+		t.Error("Deleted key should miss. Got: ", err)
+	}
+
+	// Expired keys miss, and are removed when pruning
+	cache.SetWithTTL("expiring", 1, time.Millisecond)
+	cache.Set("kept", 1)
+	time.Sleep(5 * time.Millisecond)
+	if exists, _ := cache.Exists("expiring"); exists {
+		t.Error("Key should be expired")
+	}
+	if err := cache.Get("expiring", &val); err != ErrCacheMiss {
+		t.Error("Expired key should miss. Got: ", err)
+	}
+	cache.prune()
+	if len(cache.data) != 1 {
+		t.Error("Expired key should be pruned. Got: ", cache.data)
+	}
+	cache.Close()
+}
@@ -0,0 +1,79 @@
+package goal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is an email sent to an user
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer defines a interface to send emails, e.g verification
+// and password reset emails
+type Mailer interface {
+	Send(*Mail) error
+}
+
+// MemoryMailer implements Mailer interface by keeping the mails
+// in memory, it is meant for tests
+type MemoryMailer struct {
+	mu    sync.Mutex
+	mails []*Mail
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send keeps the mail
+func (m *MemoryMailer) Send(mail *Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mails = append(m.mails, mail)
+	return nil
+}
+
+// Mails returns the mails sent so far
+func (m *MemoryMailer) Mails() []*Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Mail{}, m.mails...)
+}
+
+// FileMailer implements Mailer interface by writing each mail
+// in a file of a directory, it is meant for development
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+// Send writes the mail in a new file
+func (m *FileMailer) Send(mail *Mail) error {
+	// Keep only safe characters of the address in the file name
+	to := strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, mail.To)
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), to)
+
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", mail.To, mail.Subject, mail.Body)
+	return ioutil.WriteFile(filepath.Join(m.dir, name), []byte(content), 0600)
+}
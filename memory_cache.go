@@ -0,0 +1,133 @@
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCacheMiss = errors.New("key not found in cache")
+
+// memoryCachePruneInterval is how often expired keys are removed
+const memoryCachePruneInterval = time.Minute
+
+// memoryEntry is a cached value, which expires unless expires is zero
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// MemoryCache implements Cacher and TTLCacher interfaces in memory, values
+// are encoded as JSON like RedisCache. It is not shared between processes.
+// Expired keys are missed when read, and removed periodically
+type MemoryCache struct {
+	mu   sync.RWMutex
+	data map[string]memoryEntry
+
+	// stop ends the pruning, which runs once a key expires
+	stop chan struct{}
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{data: map[string]memoryEntry{}}
+}
+
+// Get returns data for a key
+func (m *MemoryCache) Get(key string, val interface{}) error {
+	m.mu.RLock()
+	entry, ok := m.data[key]
+	m.mu.RUnlock()
+	if !ok || entry.expired(time.Now()) {
+		return ErrCacheMiss
+	}
+	return json.Unmarshal(entry.data, val)
+}
+
+// Set a val for a key
+func (m *MemoryCache) Set(key string, val interface{}) error {
+	return m.SetWithTTL(key, val, 0)
+}
+
+// SetWithTTL sets a val for a key, which expires after ttl. A zero
+// ttl never expires
+func (m *MemoryCache) SetWithTTL(key string, val interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	entry := memoryEntry{data: data}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = entry
+	if ttl > 0 && m.stop == nil {
+		m.stop = make(chan struct{})
+		go m.pruneLoop(m.stop)
+	}
+	return nil
+}
+
+// Delete a key
+func (m *MemoryCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+// Exists checks if a key exists
+func (m *MemoryCache) Exists(key string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, ok := m.data[key]
+	return ok && !entry.expired(time.Now()), nil
+}
+
+// Close removes all the keys and stops the pruning
+func (m *MemoryCache) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = map[string]memoryEntry{}
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	return nil
+}
+
+// pruneLoop removes expired keys until stop is closed
+func (m *MemoryCache) pruneLoop(stop chan struct{}) {
+	ticker := time.NewTicker(memoryCachePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.prune()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// prune removes expired keys
+func (m *MemoryCache) prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range m.data {
+		if entry.expired(now) {
+			delete(m.data, key)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package goal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// PasswordPolicy defines the rules of the passwords of users, checked on
+// registration, password change and password reset
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// RequireUpper, RequireLower, RequireDigit and RequireSymbol
+	// require at least one character of the class
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// RejectCommon rejects the most used passwords
+	RejectCommon bool
+	// RejectUsername rejects passwords containing the username
+	RejectUsername bool
+}
+
+// RecommendedPasswordPolicy is a policy to set with WithPasswordPolicy
+var RecommendedPasswordPolicy = PasswordPolicy{MinLength: 8, RejectCommon: true, RejectUsername: true}
+
+// PasswordViolation is a rule of the policy a password does not follow
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned with the violations of a password
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password does not follow the password policy"
+}
+
+var ErrWrongPassword = errors.New("current password is not correct")
+
+// WithPasswordPolicy sets the rules of the passwords of users. Without it,
+// or with an empty policy, any password is accepted
+func WithPasswordPolicy(policy PasswordPolicy) Option {
+	return func(goal *Goal) error {
+		if policy.MinLength < 0 {
+			return errors.New("password min length cannot be negative")
+		}
+		goal.c.passwordPolicy = policy
+		return nil
+	}
+}
+
+var (
+	commonPasswordsSet  map[string]bool
+	commonPasswordsOnce sync.Once
+)
+
+// isCommonPassword reports whether the password is in the common
+// passwords, without case
+func isCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		commonPasswordsSet = make(map[string]bool, len(commonPasswords))
+		for _, p := range commonPasswords {
+			commonPasswordsSet[p] = true
+		}
+	})
+	return commonPasswordsSet[strings.ToLower(password)]
+}
+
+// containsUsername reports whether the password contains the username,
+// or the local part of an email username
+func containsUsername(password string, username string) bool {
+	password = strings.ToLower(password)
+	username = strings.ToLower(username)
+	names := []string{username}
+	if at := strings.Index(username, "@"); at > 0 {
+		names = append(names, username[:at])
+	}
+	for _, name := range names {
+		// Very short names would reject too many passwords
+		if len(name) >= 3 && strings.Contains(password, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Violations returns the rules of the policy the password does not follow
+func (p PasswordPolicy) Violations(password string, username string) []PasswordViolation {
+	var violations []PasswordViolation
+	add := func(rule string, message string) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: message})
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		add("min_length", fmt.Sprintf("password must have at least %d characters", p.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("upper", "password must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add("lower", "password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add("digit", "password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add("symbol", "password must contain a symbol")
+	}
+
+	if p.RejectCommon && isCommonPassword(password) {
+		add("common", "password is too common")
+	}
+	if p.RejectUsername && username != "" && containsUsername(password, username) {
+		add("username", "password cannot contain the username")
+	}
+	return violations
+}
+
+// ValidatePassword returns a *PasswordPolicyError if the password of
+// the username does not follow the password policy
+func (g *Goal) ValidatePassword(password string, username string) error {
+	violations := g.c.passwordPolicy.Violations(password, username)
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// policyViolations returns the violations of a *PasswordPolicyError
+func policyViolations(err error) ([]PasswordViolation, bool) {
+	policyErr, ok := err.(*PasswordPolicyError)
+	if !ok {
+		return nil, false
+	}
+	return policyErr.Violations, true
+}
+
+// username returns the username of the user
+func (g *Goal) username(user interface{}) string {
+	field, ok := g.db.NewScope(user).FieldByName(g.c.usernameColumn)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(field.Field.Interface())
+}
+
+// storedPassword returns the password hash of the user in database,
+// the password of cached users is redacted
+func (g *Goal) storedPassword(user interface{}) (string, error) {
+	scope := g.db.NewScope(user)
+	field, ok := scope.FieldByName(g.c.passwordColumn)
+	if !ok {
+		return "", fmt.Errorf("Column %s does not exist", g.c.passwordColumn)
+	}
+
+	var hashes []string
+	err := g.db.Model(user).Where(fmt.Sprintf("%s = ?", scope.Quote(scope.PrimaryKey())), scope.PrimaryKeyValue()).
+		Pluck(field.DBName, &hashes).Error
+	if err != nil {
+		return "", err
+	}
+	if len(hashes) == 0 {
+		return "", ErrEmptyPassword
+	}
+	return hashes[0], nil
+}
+
+// changePasswordHandler sets the password of current user once its
+// current password is checked. The other sessions of the user are revoked
+func (g *Goal) changePasswordHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	values, err := decodeValues(request)
+	if err != nil {
+		return valuesCode(err), nil, err
+	}
+
+	session, user, err := g.sessionUser(request)
+	if err != nil {
+		return 401, nil, err
+	}
+
+	// Current password is guessed like a login, it is locked out alike
+	username := g.username(user)
+	if until := g.lockedUntil(username, request); !until.IsZero() {
+		setRetryAfter(rw, until)
+		return 429, nil, ErrTooManyAttempts
+	}
+
+	hashed, err := g.storedPassword(user)
+	if err != nil {
+		return 500, nil, err
+	}
+	valid, err := g.VerifyPassword(values["password"], hashed)
+	if err != nil || !valid {
+		g.loginFailed(username, request)
+		return 403, nil, ErrWrongPassword
+	}
+	g.loginSucceeded(username, request)
+
+	password := values["new_password"]
+	if password == "" {
+		return 400, nil, ErrEmptyPassword
+	}
+	if err = g.ValidatePassword(password, username); err != nil {
+		violations, _ := policyViolations(err)
+		return 422, violations, err
+	}
+
+	newHash, err := g.HashPassword(password)
+	if err != nil {
+		return 500, nil, err
+	}
+	if err = g.db.Model(user).Update(g.c.passwordColumn, newHash).Error; err != nil {
+		return 500, nil, err
+	}
+
+	err = g.db.Model(&UserSession{}).Where("user_id = ? AND id <> ? AND revoked_at IS NULL", session.UserID, session.ID).
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return 500, nil, err
+	}
+	return 200, nil, nil
+}
+
+// AddPasswordPath lets authenticated users change their password
+func (g *Goal) AddPasswordPath() {
+	g.mux.HandleFunc("/auth/password", func(rw http.ResponseWriter, request *http.Request) {
+		g.renderJSON(rw, request, g.changePasswordHandler)
+	})
+}
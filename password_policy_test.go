@@ -0,0 +1,138 @@
+package goal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// violationRules returns the rules of the violations
+func violationRules(violations []PasswordViolation) map[string]bool {
+	rules := map[string]bool{}
+	for _, v := range violations {
+		rules[v.Rule] = true
+	}
+	return rules
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:      10,
+		RequireUpper:   true,
+		RequireLower:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		RejectCommon:   true,
+		RejectUsername: true,
+	}
+
+	rules := violationRules(policy.Violations("abc", ""))
+	for _, rule := range []string{"min_length", "upper", "digit", "symbol"} {
+		if !rules[rule] {
+			t.Errorf("Password should break %s rule. Got: %v", rule, rules)
+		}
+	}
+	if rules["lower"] || rules["common"] || rules["username"] {
+		t.Error("Password should only break the length and class rules. Got: ", rules)
+	}
+
+	if rules = violationRules(policy.Violations("Password123", "")); !rules["common"] {
+		t.Error("Common password should be rejected whatever the case. Got: ", rules)
+	}
+	if rules = violationRules(policy.Violations("Adphi-2024!", "adphi@example.com")); !rules["username"] {
+		t.Error("Password containing the username should be rejected. Got: ", rules)
+	}
+	if violations := policy.Violations("Correct-Horse-42", "adphi@example.com"); len(violations) != 0 {
+		t.Error("Password should follow the policy. Got: ", violations)
+	}
+	if violations := (PasswordPolicy{}).Violations("a", "a"); len(violations) != 0 {
+		t.Error("Empty policy should accept any password. Got: ", violations)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	ng, serve := setupAccounts(t, WithPasswordPolicy(RecommendedPasswordPolicy))
+	defer ng.Close()
+
+	res := serve("POST", "/auth/register", `{"email": "adphi@example.com", "secret": "password"}`, "")
+	if res.Code != 422 {
+		t.Fatal("Weak password should be rejected. Got: ", res.Code)
+	}
+	var body struct {
+		Message string
+		Data    []PasswordViolation
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || !violationRules(body.Data)["common"] {
+		t.Error("Violations should be returned. Got: ", res.Body.String())
+	}
+
+	res = serve("POST", "/auth/register", `{"email": "adphi@example.com", "secret": "something-secret"}`, "")
+	if res.Code != 200 {
+		t.Fatal("User should be registered. Got: ", res.Code, res.Body.String())
+	}
+	other := res.Header().Get("Set-Cookie")
+	res = serve("POST", "/auth/login", `{"email": "adphi@example.com", "secret": "something-secret"}`, "")
+	cookie := res.Header().Get("Set-Cookie")
+
+	if res = serve("POST", "/auth/password", `{"password": "something-secret", "new_password": "new-secret"}`, ""); res.Code != 401 {
+		t.Error("Anonymous user should not change password. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/password", `{"password": "wrong", "new_password": "new-secret"}`, cookie); res.Code != 403 {
+		t.Error("Wrong current password should be rejected. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/password", `{"password": "something-secret", "new_password": "adphi-123"}`, cookie); res.Code != 422 {
+		t.Error("New password should follow the policy. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/password", `{"password": "something-secret", "new_password": "new-secret"}`, cookie); res.Code != 200 {
+		t.Fatal("Password should be changed. Got: ", res.Code, res.Body.String())
+	}
+
+	if res = serve("GET", "/auth/me", "", cookie); res.Code != 200 {
+		t.Error("Current session should be kept. Got: ", res.Code)
+	}
+	if res = serve("GET", "/auth/me", "", other); res.Code != 401 {
+		t.Error("Other sessions should be revoked. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/login", `{"email": "adphi@example.com", "secret": "new-secret"}`, ""); res.Code != 200 {
+		t.Error("User should login with new password. Got: ", res.Code)
+	}
+}
+
+func TestPasswordPolicyOptIn(t *testing.T) {
+	ng, serve := setupAccounts(t)
+	defer ng.Close()
+
+	if res := serve("POST", "/auth/register", `{"email": "adphi@example.com", "secret": "password"}`, ""); res.Code != 200 {
+		t.Error("Any password should be accepted without policy. Got: ", res.Code, res.Body.String())
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	ng, serve := setupAccounts(t, WithLoginLimits(LoginLimits{Attempts: 3, Lockout: time.Minute}))
+	defer ng.Close()
+
+	res := serve("POST", "/auth/register", `{"email": "adphi@example.com", "secret": "something-secret"}`, "")
+	cookie := res.Header().Get("Set-Cookie")
+
+	wrong := `{"password": "wrong", "new_password": "new-secret"}`
+	for i := 0; i < 3; i++ {
+		if res = serve("POST", "/auth/password", wrong, cookie); res.Code != 403 {
+			t.Fatal("Wrong current password should be rejected. Got: ", res.Code)
+		}
+	}
+
+	// Right password is refused during the lockout
+	right := `{"password": "something-secret", "new_password": "new-secret"}`
+	res = serve("POST", "/auth/password", right, cookie)
+	if res.Code != 429 || res.Header().Get("Retry-After") == "" {
+		t.Error("Password change should be locked out. Got: ", res.Code, res.Header())
+	}
+	if res = serve("POST", "/auth/login", `{"email": "adphi@example.com", "secret": "something-secret"}`, ""); res.Code != 429 {
+		t.Error("Login should be locked out too. Got: ", res.Code)
+	}
+
+	ng.ResetLoginAttempts("adphi@example.com")
+	if res = serve("POST", "/auth/password", right, cookie); res.Code != 200 {
+		t.Error("Password should be changed after reset. Got: ", res.Code, res.Body.String())
+	}
+}
@@ -0,0 +1,350 @@
+// passwords hashes the passwords of users. Hashes are PHC strings, e.g
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>, so that each hash keeps
+// its parameters. Passwords hashed with other parameters or algorithms
+// are still accepted, and hashed again on login
+
+package goal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher defines a interface to hash and verify passwords
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the hash
+	Verify(password string, hash string) (bool, error)
+	// NeedsRehash reports whether the hash was made with another
+	// algorithm or other parameters than the hasher
+	NeedsRehash(hash string) bool
+}
+
+var (
+	ErrNilPasswordHasher = errors.New("password hasher cannot be nil")
+	ErrUnknownHash       = errors.New("unknown password hash format")
+	ErrInvalidHash       = errors.New("invalid password hash")
+)
+
+// BcryptHasher implements PasswordHasher interface with bcrypt
+type BcryptHasher struct {
+	// Cost is bcrypt.DefaultCost if zero
+	Cost int
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+// Hash returns the bcrypt hash of the password
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	return string(hashed), err
+}
+
+// Verify reports whether the password matches the bcrypt hash
+func (h BcryptHasher) Verify(password string, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// NeedsRehash reports whether the hash is not a bcrypt hash of the cost
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost()
+}
+
+// Argon2idHasher implements PasswordHasher interface with argon2id
+type Argon2idHasher struct {
+	// Time is the number of passes, 3 by default
+	Time uint32
+	// Memory is in KiB, 64 MiB by default
+	Memory uint32
+	// Threads is 4 by default
+	Threads uint8
+	// KeyLen is 32 bytes by default
+	KeyLen uint32
+	// SaltLen is 16 bytes by default
+	SaltLen uint32
+}
+
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	if h.Time == 0 {
+		h.Time = 3
+	}
+	if h.Memory == 0 {
+		h.Memory = 64 * 1024
+	}
+	if h.Threads == 0 {
+		h.Threads = 4
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+	return h
+}
+
+// Hash returns the argon2id hash of the password
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+	salt, err := randomSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		encodeHashPart(salt), encodeHashPart(key)), nil
+}
+
+// parse returns the parameters, salt and key of an argon2id hash
+func (h Argon2idHasher) parse(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var parsed Argon2idHasher
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return parsed, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return parsed, nil, nil, ErrInvalidHash
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.Memory, &parsed.Time, &parsed.Threads)
+	if err != nil {
+		return parsed, nil, nil, ErrInvalidHash
+	}
+
+	salt, key, err := decodeSaltAndKey(parts[4], parts[5])
+	if err != nil {
+		return parsed, nil, nil, err
+	}
+	parsed.SaltLen = uint32(len(salt))
+	parsed.KeyLen = uint32(len(key))
+	return parsed, salt, key, nil
+}
+
+// Verify reports whether the password matches the argon2id hash
+func (h Argon2idHasher) Verify(password string, hash string) (bool, error) {
+	p, salt, key, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether the hash is not an argon2id hash of the parameters
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	p, _, _, err := h.parse(hash)
+	return err != nil || p != h.withDefaults()
+}
+
+// ScryptHasher implements PasswordHasher interface with scrypt
+type ScryptHasher struct {
+	// LogN is the log2 of the CPU/memory cost, 15 by default
+	LogN uint8
+	// R is the block size, 8 by default
+	R int
+	// P is the parallelization, 1 by default
+	P int
+	// KeyLen is 32 bytes by default
+	KeyLen int
+	// SaltLen is 16 bytes by default
+	SaltLen int
+}
+
+func (h ScryptHasher) withDefaults() ScryptHasher {
+	if h.LogN == 0 {
+		h.LogN = 15
+	}
+	if h.R == 0 {
+		h.R = 8
+	}
+	if h.P == 0 {
+		h.P = 1
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+	return h
+}
+
+// Hash returns the scrypt hash of the password
+func (h ScryptHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+	salt, err := randomSalt(uint32(h.SaltLen))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P,
+		encodeHashPart(salt), encodeHashPart(key)), nil
+}
+
+// parse returns the parameters, salt and key of a scrypt hash
+func (h ScryptHasher) parse(hash string) (ScryptHasher, []byte, []byte, error) {
+	var parsed ScryptHasher
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return parsed, nil, nil, ErrUnknownHash
+	}
+
+	_, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &parsed.LogN, &parsed.R, &parsed.P)
+	if err != nil {
+		return parsed, nil, nil, ErrInvalidHash
+	}
+
+	salt, key, err := decodeSaltAndKey(parts[3], parts[4])
+	if err != nil {
+		return parsed, nil, nil, err
+	}
+	parsed.SaltLen = len(salt)
+	parsed.KeyLen = len(key)
+	return parsed, salt, key, nil
+}
+
+// Verify reports whether the password matches the scrypt hash
+func (h ScryptHasher) Verify(password string, hash string) (bool, error) {
+	p, salt, key, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, p.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether the hash is not a scrypt hash of the parameters
+func (h ScryptHasher) NeedsRehash(hash string) bool {
+	p, _, _, err := h.parse(hash)
+	return err != nil || p != h.withDefaults()
+}
+
+// randomSalt returns a random salt of n bytes
+func randomSalt(n uint32) ([]byte, error) {
+	salt := make([]byte, n)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// encodeHashPart encodes a salt or a key like PHC strings, in base64
+// without padding
+func encodeHashPart(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decodeSaltAndKey(salt string, key string) ([]byte, []byte, error) {
+	s, err := base64.RawStdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, nil, ErrInvalidHash
+	}
+	k, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil || len(k) == 0 {
+		return nil, nil, ErrInvalidHash
+	}
+	return s, k, nil
+}
+
+// hasherOf returns a hasher verifying the hash, from its prefix
+func hasherOf(hash string) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2idHasher{}, nil
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return ScryptHasher{}, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return BcryptHasher{}, nil
+	}
+	return nil, ErrUnknownHash
+}
+
+// passwordHashing hashes the passwords of a goal instance
+type passwordHashing struct {
+	hasher PasswordHasher
+
+	// dummy is verified when an username does not exist
+	dummyOnce sync.Once
+	dummy     string
+}
+
+func newPasswordHashing() *passwordHashing {
+	return &passwordHashing{hasher: BcryptHasher{}}
+}
+
+// WithPasswordHasher hashes new passwords with hasher, bcrypt by default.
+// Passwords hashed before are hashed again when users login
+func WithPasswordHasher(hasher PasswordHasher) Option {
+	return func(goal *Goal) error {
+		if hasher == nil {
+			return ErrNilPasswordHasher
+		}
+		goal.passwords.hasher = hasher
+		return nil
+	}
+}
+
+// HashPassword returns the hash of the password to store in the
+// password column
+func (g *Goal) HashPassword(password string) (string, error) {
+	return g.passwords.hasher.Hash(password)
+}
+
+// VerifyPassword reports whether the password matches the hash, whatever
+// the algorithm of the hash. The configured hasher verifies the hashes it
+// made, and the ones of an unknown format so that custom hashers can verify
+// their hashes made with other parameters
+func (g *Goal) VerifyPassword(password string, hash string) (bool, error) {
+	configured := g.passwords.hasher
+	if !configured.NeedsRehash(hash) {
+		return configured.Verify(password, hash)
+	}
+
+	hasher, err := hasherOf(hash)
+	if err == ErrUnknownHash {
+		return configured.Verify(password, hash)
+	}
+	if err != nil {
+		return false, err
+	}
+	return hasher.Verify(password, hash)
+}
+
+// verifyDummyPassword takes as long as verifying a password, so that
+// unknown usernames are not answered faster
+func (g *Goal) verifyDummyPassword(password string) {
+	p := g.passwords
+	p.dummyOnce.Do(func() {
+		p.dummy, _ = p.hasher.Hash("goal-dummy-password")
+	})
+	if p.dummy != "" {
+		g.VerifyPassword(password, p.dummy)
+	}
+}
@@ -0,0 +1,151 @@
+package goal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"$2a$":       BcryptHasher{Cost: 4},
+		"$argon2id$": Argon2idHasher{Time: 1, Memory: 1024, Threads: 1},
+		"$scrypt$":   ScryptHasher{LogN: 4},
+	}
+
+	for prefix, hasher := range hashers {
+		hash, err := hasher.Hash("something-secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, prefix) {
+			t.Errorf("Hash should start with %s. Got: %s", prefix, hash)
+		}
+
+		if valid, err := hasher.Verify("something-secret", hash); !valid || err != nil {
+			t.Errorf("%s hash should match the password. Got: %v", prefix, err)
+		}
+		if valid, _ := hasher.Verify("wrong", hash); valid {
+			t.Errorf("%s hash should not match a wrong password", prefix)
+		}
+		if hasher.NeedsRehash(hash) {
+			t.Errorf("%s hash should not need a rehash", prefix)
+		}
+
+		// Other algorithms are always hashed again
+		for other, otherHasher := range hashers {
+			if other != prefix && !otherHasher.NeedsRehash(hash) {
+				t.Errorf("%s hash should be rehashed by %s", prefix, other)
+			}
+		}
+	}
+
+	if !(BcryptHasher{Cost: 5}).NeedsRehash(mustHash(t, BcryptHasher{Cost: 4})) {
+		t.Error("Bcrypt cost change should need a rehash")
+	}
+	if !(Argon2idHasher{Time: 2, Memory: 1024, Threads: 1}).NeedsRehash(mustHash(t, hashers["$argon2id$"])) {
+		t.Error("Argon2id parameters change should need a rehash")
+	}
+	if !(ScryptHasher{LogN: 5}).NeedsRehash(mustHash(t, hashers["$scrypt$"])) {
+		t.Error("Scrypt parameters change should need a rehash")
+	}
+
+	if _, err := (Argon2idHasher{}).Verify("secret", "$argon2id$v=19$m=1024$salt"); err == nil {
+		t.Error("Invalid hash should fail")
+	}
+}
+
+func mustHash(t *testing.T, hasher PasswordHasher) string {
+	hash, err := hasher.Hash("something-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPasswordRehash(t *testing.T) {
+	ng, serve := setupAccounts(t, WithPasswordHasher(Argon2idHasher{Time: 1, Memory: 1024, Threads: 1}))
+	defer ng.Close()
+
+	// Password hashed before the hasher changed
+	user := &account{Email: "adphi@example.com", Secret: mustHash(t, BcryptHasher{Cost: 4})}
+	ng.db.Create(user)
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	if res := serve("POST", "/auth/login", body, ""); res.Code != 200 {
+		t.Fatal("User should login with previous hash. Got: ", res.Code, res.Body.String())
+	}
+
+	stored := &account{}
+	ng.db.First(stored, user.ID)
+	if !strings.HasPrefix(stored.Secret, "$argon2id$") {
+		t.Fatal("Password should be rehashed. Got: ", stored.Secret)
+	}
+
+	if res := serve("POST", "/auth/login", body, ""); res.Code != 200 {
+		t.Error("User should login with new hash. Got: ", res.Code)
+	}
+	if res := serve("POST", "/auth/login", `{"email": "adphi@example.com", "secret": "wrong"}`, ""); res.Code != 401 {
+		t.Error("Wrong password should be rejected. Got: ", res.Code)
+	}
+}
+
+// saltedHasher is a custom hasher with its own format
+type saltedHasher struct {
+	Salt string
+}
+
+func (h saltedHasher) Hash(password string) (string, error) {
+	return fmt.Sprintf("$salted$%s$%x", h.Salt, sha256.Sum256([]byte(h.Salt+password))), nil
+}
+
+func (h saltedHasher) Verify(password string, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[1] != "salted" {
+		return false, ErrUnknownHash
+	}
+	return hash == fmt.Sprintf("$salted$%s$%x", parts[2], sha256.Sum256([]byte(parts[2]+password))), nil
+}
+
+func (h saltedHasher) NeedsRehash(hash string) bool {
+	return !strings.HasPrefix(hash, "$salted$"+h.Salt+"$")
+}
+
+func TestCustomPasswordHasher(t *testing.T) {
+	ng, err := NewGoal(WithDBAddress("sqlite3", ":memory:"), WithPasswordHasher(saltedHasher{Salt: "new"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ng.Close()
+
+	// Hashes of the hasher, of its previous parameters and of built-in hashers
+	for _, hasher := range []PasswordHasher{saltedHasher{Salt: "new"}, saltedHasher{Salt: "old"}, BcryptHasher{Cost: 4}} {
+		hash := mustHash(t, hasher)
+		if valid, err := ng.VerifyPassword("something-secret", hash); !valid || err != nil {
+			t.Errorf("Hash %s should match the password. Got: %v", hash, err)
+		}
+		if valid, _ := ng.VerifyPassword("wrong", hash); valid {
+			t.Errorf("Hash %s should not match a wrong password", hash)
+		}
+	}
+}
+
+func TestPasswordUnknownHash(t *testing.T) {
+	ng, serve := setupAccounts(t, WithLoginLimits(LoginLimits{Attempts: 2, Lockout: time.Minute}))
+	defer ng.Close()
+
+	// Password imported from another system, bcrypt cannot read it
+	ng.db.Create(&account{Email: "adphi@example.com", Secret: "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="})
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	res := serve("POST", "/auth/login", body, "")
+	if res.Code != 401 || !strings.Contains(res.Body.String(), ErrInvalidCredentials.Error()) {
+		t.Error("Unknown hash should fail like a wrong password. Got: ", res.Code, res.Body.String())
+	}
+	serve("POST", "/auth/login", body, "")
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 429 {
+		t.Error("Unknown hash failures should be counted. Got: ", res.Code)
+	}
+}
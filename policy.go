@@ -0,0 +1,153 @@
+package goal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Policy restricts the records of a model to the ones whose column
+// equals a field of the current user. It is applied to read, update,
+// delete and query, and set on created records
+type Policy struct {
+	// Column of the model, e.g "owner_id"
+	Column string
+	// UserField is the field of the user model compared to the column,
+	// the primary key of the user if empty
+	UserField string
+}
+
+// OwnerPolicy restricts records to the ones where column is the
+// current user id
+func OwnerPolicy(column string) Policy {
+	return Policy{Column: column}
+}
+
+// FieldPolicy restricts records to the ones where column equals the
+// field of the current user, e.g FieldPolicy("tenant_id", "TenantID")
+func FieldPolicy(column string, userField string) Policy {
+	return Policy{Column: column, UserField: userField}
+}
+
+var ErrPolicyViolation = errors.New("record does not satisfy access policy")
+
+// AddPolicies restricts the records of resource a user can access
+func (g *Goal) AddPolicies(resource interface{}, policies ...Policy) {
+	if g.policies == nil {
+		g.policies = map[reflect.Type][]Policy{}
+	}
+	rType := reflect.TypeOf(resource)
+	g.policies[rType] = append(g.policies[rType], policies...)
+}
+
+// userValue returns the value of the user field required by the policy
+func (g *Goal) userValue(p Policy, user interface{}) (interface{}, error) {
+	scope := g.db.NewScope(user)
+	if p.UserField == "" {
+		return scope.PrimaryKeyValue(), nil
+	}
+
+	field, ok := scope.FieldByName(p.UserField)
+	if !ok {
+		errorMsg := fmt.Sprintf("User field %s does not exist", p.UserField)
+		return nil, errors.New(errorMsg)
+	}
+	return field.Field.Interface(), nil
+}
+
+// policyValues returns the values of the policy columns for the current user.
+// It returns nil if the model has no policy
+func (g *Goal) policyValues(rType reflect.Type, request *http.Request) (map[string]interface{}, error) {
+	policies := g.policies[rType]
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	// Policies always require an user
+	user, err := g.getCurrentUser(request)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := g.db.NewScope(newObjectWithType(rType))
+	values := map[string]interface{}{}
+	for _, p := range policies {
+		field, ok := scope.FieldByName(p.Column)
+		if !ok {
+			errorMsg := fmt.Sprintf("Column %s does not exist", p.Column)
+			return nil, errors.New(errorMsg)
+		}
+
+		value, err := g.userValue(p, user)
+		if err != nil {
+			return nil, err
+		}
+		values[field.DBName] = value
+	}
+	return values, nil
+}
+
+// policyScope returns a scope restricting the records of the model to the
+// ones the current user can access. It returns nil if the model has no policy
+func (g *Goal) policyScope(rType reflect.Type, request *http.Request) (func(*gorm.DB) *gorm.DB, error) {
+	values, err := g.policyValues(rType, request)
+	if err != nil || values == nil {
+		return nil, err
+	}
+
+	scope := g.db.NewScope(newObjectWithType(rType))
+	return func(db *gorm.DB) *gorm.DB {
+		for column, value := range values {
+			db = db.Where(fmt.Sprintf("%s.%s = ?", scope.QuotedTableName(), scope.Quote(column)), value)
+		}
+		return db
+	}, nil
+}
+
+// enforcePolicies sets the policy columns of a record which are blank,
+// and fails if the others does not match the current user
+func (g *Goal) enforcePolicies(resource interface{}, request *http.Request) error {
+	values, err := g.policyValues(reflect.TypeOf(resource), request)
+	if err != nil || values == nil {
+		return err
+	}
+
+	scope := g.db.NewScope(resource)
+	for column, value := range values {
+		field, _ := scope.FieldByName(column)
+		if field.IsBlank {
+			if err = field.Set(value); err != nil {
+				return err
+			}
+			continue
+		}
+		if c, err := compareValues(reflect.Indirect(field.Field).Interface(), value); err != nil || c != 0 {
+			return ErrPolicyViolation
+		}
+	}
+	return nil
+}
+
+// matchPolicies reports whether the current user can access the record
+func (g *Goal) matchPolicies(resource interface{}, request *http.Request) bool {
+	values, err := g.policyValues(reflect.TypeOf(resource), request)
+	if err != nil {
+		return false
+	}
+
+	scope := g.db.NewScope(resource)
+	for column, value := range values {
+		field, _ := scope.FieldByName(column)
+		current := reflect.Indirect(field.Field)
+		if !current.IsValid() {
+			return false
+		}
+		if c, err := compareValues(current.Interface(), value); err != nil || c != 0 {
+			return false
+		}
+	}
+	return true
+}
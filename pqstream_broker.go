@@ -0,0 +1,119 @@
+// pqstream_broker publishes changes notified by postgres, using
+// triggers installed by pqstream
+
+package goal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.bertha.cloud/partitio/pqstream"
+)
+
+// pqStreamBroker implements Broker interface with postgres notifications,
+// so changes made by any goal instance, or directly inside the database, are seen
+type pqStreamBroker struct {
+	g        *Goal
+	streamer *pqstream.Streamer
+	memory   *MemoryBroker
+}
+
+func newPQStreamBroker(g *Goal) (*pqStreamBroker, error) {
+	if g.db.Dialect().GetName() != "postgres" {
+		return nil, ErrLiveQueryUnsupportedDB
+	}
+
+	streamer, err := pqstream.NewStreamer(g.c.dbAddress)
+	if err != nil {
+		return nil, err
+	}
+	events, err := streamer.Listen(g.ctx)
+	if err != nil {
+		streamer.Close()
+		return nil, err
+	}
+
+	b := &pqStreamBroker{g: g, streamer: streamer, memory: NewMemoryBroker()}
+	go func() {
+		for {
+			select {
+			case <-g.ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				event, err := b.event(e)
+				if err != nil {
+					logrus.Errorf("Live query: %v", err)
+					continue
+				}
+				if event != nil {
+					b.memory.Publish(event)
+				}
+			}
+		}
+	}()
+	return b, nil
+}
+
+// Publish does nothing as postgres notifies the changes itself
+func (b *pqStreamBroker) Publish(*LiveEvent) error {
+	return nil
+}
+
+func (b *pqStreamBroker) Subscribe(ctx context.Context) (<-chan *LiveEvent, error) {
+	return b.memory.Subscribe(ctx)
+}
+
+func (b *pqStreamBroker) Close() error {
+	err := b.streamer.Close()
+	b.memory.Close()
+	return err
+}
+
+// event converts a postgres notification to an event.
+// Created and updated records are reloaded from database, deleted records
+// are rebuilt from the notification payload
+func (b *pqStreamBroker) event(e *pqstream.Event) (*LiveEvent, error) {
+	rType, ok := b.g.resourceType(e.Table)
+	if !ok {
+		// Table is not exposed by goal
+		return nil, nil
+	}
+	resource := newObjectWithType(rType)
+
+	var eventType LiveEventType
+	switch e.Op {
+	case "INSERT":
+		eventType = LiveCreate
+	case "UPDATE":
+		eventType = LiveUpdate
+	case "DELETE":
+		eventType = LiveDelete
+	default:
+		return nil, fmt.Errorf("unknown operation %s on %s", e.Op, e.Table)
+	}
+
+	scope := b.g.db.NewScope(resource)
+	if eventType == LiveDelete {
+		var values map[string]interface{}
+		if err := json.Unmarshal(e.Payload, &values); err != nil {
+			return nil, err
+		}
+		for column, value := range values {
+			if scope.HasColumn(column) {
+				scope.SetColumn(column, value)
+			}
+		}
+	} else {
+		key := fmt.Sprintf("%s = ?", scope.PrimaryKey())
+		if err := b.g.db.Where(key, e.ID).First(resource).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return &LiveEvent{Type: eventType, Table: e.Table, Object: resource}, nil
+}
@@ -15,16 +15,18 @@ type QuerySupporter interface {
 func (g *Goal) queryHandler(resource interface{}) http.HandlerFunc {
 	return func(rw http.ResponseWriter, request *http.Request) {
 		var handler simpleResponse
+		custom := false
 
 		if r, ok := resource.(QuerySupporter); ok {
 			handler = r.Query
-		} else if a, ok := g.resources[reflect.TypeOf(resource)]; ok && a.Query {
+			custom = true
+		} else if _, ok := g.resources[reflect.TypeOf(resource)]; ok {
 			handler = func(writer http.ResponseWriter, r *http.Request) (int, interface{}, error) {
 				return g.handleQuery(reflect.TypeOf(resource), r)
 			}
 		}
 
-		renderJSON(rw, request, handler)
+		g.renderJSON(rw, request, g.guard(resource, ActionQuery, handler, custom))
 	}
 }
 
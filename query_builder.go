@@ -13,6 +13,8 @@ type query struct {
 	s     int64
 	i     []string
 	o     map[string]bool
+	c     *string
+	next  string
 	Error error
 }
 
@@ -56,6 +58,19 @@ func (q *query) Skip(i int64) *query {
 	return q
 }
 
+// After enables cursor pagination, starting after cursor. An empty
+// cursor returns the first page
+func (q *query) After(cursor string) *query {
+	q.c = &cursor
+	return q
+}
+
+// Next returns the cursor of the page following the results of Find,
+// it is empty when there is no more results
+func (q *query) Next() string {
+	return q.next
+}
+
 func (q *query) Order(key string, order Order, reorder bool) *query {
 	s := fmt.Sprint(key, " ", order)
 	if q.o == nil {
@@ -116,17 +131,28 @@ func (q *query) Like(val interface{}) *query {
 	return q.op(Like, val)
 }
 
-func (q *query) Find(resource interface{}, results interface{}) error {
-	p := queryParams{
+func (q *query) params() *queryParams {
+	return &queryParams{
 		db:      q.db,
 		Where:   q.w,
 		Order:   q.o,
 		Limit:   q.l,
 		Skip:    q.s,
 		Include: q.i,
+		Cursor:  q.c,
 	}
+}
+
+func (q *query) Find(resource interface{}, results interface{}) error {
+	p := q.params()
+	err := p.Find(resource, results)
+	q.next = p.next
+	return err
+}
 
-	return p.Find(resource, results)
+// Count returns the number of records matching the where clauses
+func (q *query) Count(resource interface{}) (int64, error) {
+	return q.params().Total(resource)
 }
 
 func (q *query) validate() error {
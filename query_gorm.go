@@ -1,13 +1,15 @@
 // Define data structure for a query request
 // {
 //   "where":[{"key": "name", "op": "=", "val": "Thomas"}],
-//   "order": [{"key": "name", "val": "asc"}]
-//   "limit": 1
+//   "order": {"name DESC": false},
+//   "limit": 1,
+//   "cursor": ""
 // }
 
 package goal
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,7 +17,11 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -66,18 +72,130 @@ type QueryItem struct {
 }
 
 // queryParams defines structure of a query. Where clause
-// may include multiple QueryItem and connect by "AND" operator
+// may include multiple QueryItem and connect by "AND" operator.
+// Cursor enables keyset pagination: it is empty for the first page,
+// then the next cursor returned with the results.
+// Envelope wraps the results with paging metadata, Count adds the
+// number of records matching the where clauses to it
 type queryParams struct {
-	db      *gorm.DB        `json:"-"`
-	Where   []*QueryItem    `json:"where"`
-	Limit   int64           `json:"limit"`
-	Skip    int64           `json:"skip"`
-	Order   map[string]bool `json:"order"`
-	Include []string        `json:"include"`
+	g        *Goal           `json:"-"`
+	db       *gorm.DB        `json:"-"`
+	Where    []*QueryItem    `json:"where"`
+	Limit    int64           `json:"limit"`
+	Skip     int64           `json:"skip"`
+	Order    map[string]bool `json:"order"`
+	Include  []string        `json:"include"`
+	Cursor   *string         `json:"cursor"`
+	Envelope bool            `json:"envelope"`
+	Count    bool            `json:"count"`
+
+	// next is the cursor of the page following the results
+	next string
+	// roles are the roles of the user sending the query, fields
+	// they cannot read cannot be queried
+	roles *requestRoles
+	// scopes are applied to the query, like access control
+	scopes []func(*gorm.DB) *gorm.DB
+}
+
+// checkVisible fails if current user cannot read the field. Queries
+// built by the server, without goal, can use any field
+func (params *queryParams) checkVisible(scope *gorm.Scope, field *gorm.Field) error {
+	if params.g == nil {
+		return nil
+	}
+
+	// Anonymous users have no roles
+	var roles []string
+	if params.roles != nil {
+		roles, _ = params.roles.get()
+	}
+	if !params.g.readableColumn(scope, field, roles) {
+		return queryErrorf("Column cannot be queried: %s", field.DBName)
+	}
+	return nil
+}
+
+// checkWhere fails if the item or one of its "or" items filters
+// on a field clients cannot query
+func (params *queryParams) checkWhere(scope *gorm.Scope, item *QueryItem) error {
+	for _, it := range append([]*QueryItem{item}, item.Or...) {
+		field, ok := scope.FieldByName(it.Key)
+		if !ok {
+			continue
+		}
+		if err := params.checkVisible(scope, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryPage is returned by the query endpoint when an envelope is requested
+// or a cursor is used. Count is the number of records matching the query.
+// Access control of models embedding Permission is applied by the database,
+// others records are filtered afterwards so clients can tell if some were dropped
+type queryPage struct {
+	Results interface{} `json:"results"`
+	Count   *int64      `json:"count,omitempty"`
+	Limit   int64       `json:"limit"`
+	Skip    int64       `json:"skip"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// orderKey is a column used to sort results
+type orderKey struct {
+	column  string
+	desc    bool
+	reorder bool
+}
+
+func (o orderKey) String() string {
+	if o.desc {
+		return fmt.Sprintf("%s %s", o.column, Desc)
+	}
+	return fmt.Sprintf("%s %s", o.column, Asc)
+}
+
+// cursor stores the sort keys and the values of the last record of a page
+type cursor struct {
+	Keys   []string          `json:"k"`
+	Values []json.RawMessage `json:"v"`
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// QueryError is returned when a query sent by a client is invalid,
+// other errors come from the database
+type QueryError struct {
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+// queryErrorf returns a *QueryError with the formatted message
+func queryErrorf(format string, args ...interface{}) error {
+	return &QueryError{Message: fmt.Sprintf(format, args...)}
+}
+
+// isQueryError reports whether the query is invalid, as opposed to
+// an error of the database
+func isQueryError(err error) bool {
+	_, ok := err.(*QueryError)
+	return ok || err == ErrInvalidCursor
 }
 
 func (g *Goal) NewQueryParams() *queryParams {
-	return &queryParams{db: g.db}
+	return &queryParams{g: g, db: g.db}
+}
+
+// requestQueryParams returns the params of a query sent by current user
+func (g *Goal) requestQueryParams(request *http.Request) *queryParams {
+	params := g.NewQueryParams()
+	params.roles = g.requestRoles(request)
+	return params
 }
 
 // Find constructs the query, return error immediately if query is invalid,
@@ -85,65 +203,235 @@ func (g *Goal) NewQueryParams() *queryParams {
 func (params *queryParams) Find(resource interface{}, results interface{}) error {
 	scope := params.db.NewScope(resource)
 
-	qryDB := params.db.New()
+	qryDB, err := params.whereDB(scope)
+	if err != nil {
+		return err
+	}
 
-	// Parse where clause
-	if params.Where != nil {
-		for _, item := range params.Where {
-			query, err := item.getQuery(scope)
+	if params.Limit != 0 {
+		qryDB = qryDB.Limit(params.Limit)
+	}
 
-			// Return immediately if query is invalid
+	keys, err := params.orderKeys(scope)
+	if err != nil {
+		return err
+	}
+
+	if params.Cursor != nil {
+		// Primary key makes the order unique
+		keys = append(keys, orderKey{column: scope.PrimaryKey()})
+
+		if *params.Cursor != "" {
+			query, args, err := keysetQuery(scope, keys, *params.Cursor)
 			if err != nil {
 				return err
 			}
+			qryDB = qryDB.Where(query, args...)
+		}
+	} else if params.Skip != 0 {
+		qryDB = qryDB.Offset(params.Skip)
+	}
 
-			qryDB = qryDB.Where(query, item.Val)
+	for _, key := range keys {
+		qryDB = qryDB.Order(key.String(), key.reorder)
+	}
 
-			if item.Or != nil {
-				for _, orItem := range item.Or {
-					query, err = orItem.getQuery(scope)
+	if params.Include != nil {
+		for _, name := range params.Include {
+			qryDB = qryDB.Preload(strings.Title(name))
+		}
+	}
 
-					// Return immediately if query is invalid
-					if err != nil {
-						return err
-					}
+	// query the database
+	if err = qryDB.Find(results).Error; err != nil {
+		return err
+	}
 
-					qryDB = qryDB.Or(query, orItem.Val)
-				}
+	params.next = ""
+	if params.Cursor != nil && params.Limit != 0 {
+		s := reflect.ValueOf(results).Elem()
+		if int64(s.Len()) == params.Limit {
+			next, err := encodeCursor(scope, keys, s.Index(s.Len()-1).Interface())
+			if err != nil {
+				return err
 			}
+			params.next = next
 		}
 	}
 
-	if params.Limit != 0 {
-		qryDB = qryDB.Limit(params.Limit)
+	return nil
+}
+
+// Total returns the number of records matching the where clauses,
+// ignoring limit, skip and cursor
+func (params *queryParams) Total(resource interface{}) (int64, error) {
+	scope := params.db.NewScope(resource)
+
+	qryDB, err := params.whereDB(scope)
+	if err != nil {
+		return 0, err
 	}
 
-	if params.Skip != 0 {
-		qryDB = qryDB.Offset(params.Skip)
+	var count int64
+	err = qryDB.Model(resource).Count(&count).Error
+	return count, err
+}
+
+// whereDB returns a new db with the where clauses of the query
+func (params *queryParams) whereDB(scope *gorm.Scope) (*gorm.DB, error) {
+	qryDB := params.db.New().Scopes(params.scopes...)
+
+	for _, item := range params.Where {
+		if err := params.checkWhere(scope, item); err != nil {
+			return nil, err
+		}
+
+		query, err := item.getQuery(scope)
+
+		// Return immediately if query is invalid
+		if err != nil {
+			return nil, err
+		}
+
+		queries := []string{query}
+		args := []interface{}{item.Val}
+
+		for _, orItem := range item.Or {
+			query, err = orItem.getQuery(scope)
+
+			// Return immediately if query is invalid
+			if err != nil {
+				return nil, err
+			}
+
+			queries = append(queries, query)
+			args = append(args, orItem.Val)
+		}
+
+		qryDB = qryDB.Where(fmt.Sprintf("(%s)", strings.Join(queries, " OR ")), args...)
+	}
+
+	return qryDB, nil
+}
+
+// orderKeys parses the order of the query, "name" or "name DESC".
+// Keys are sorted by name so that the order is always the same
+func (params *queryParams) orderKeys(scope *gorm.Scope) ([]orderKey, error) {
+	names := make([]string, 0, len(params.Order))
+	for name := range params.Order {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	if params.Order != nil {
-		for name, order := range params.Order {
-			name = strings.Title(name)
-			if !scope.HasColumn(name) {
-				errorMsg := fmt.Sprintf("Column %s does not exist", name)
-				return errors.New(errorMsg)
+	var keys []orderKey
+	for _, name := range names {
+		parts := strings.Fields(name)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, queryErrorf("Invalid order: %s", name)
+		}
+
+		field, ok := scope.FieldByName(parts[0])
+		if !ok {
+			field, ok = scope.FieldByName(strings.Title(parts[0]))
+		}
+		if !ok || field.IsIgnored {
+			return nil, queryErrorf("Column %s does not exist", parts[0])
+		}
+		// The cursor contains the values of the order keys
+		if err := params.checkVisible(scope, field); err != nil {
+			return nil, err
+		}
+
+		key := orderKey{column: field.DBName, reorder: params.Order[name]}
+		if len(parts) == 2 {
+			switch Order(strings.ToUpper(parts[1])) {
+			case Asc:
+			case Desc:
+				key.desc = true
+			default:
+				return nil, queryErrorf("Invalid order: %s", name)
 			}
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
 
-			qryDB = qryDB.Order(name, order)
+// encodeCursor returns the cursor pointing after resource
+func encodeCursor(scope *gorm.Scope, keys []orderKey, resource interface{}) (string, error) {
+	last := scope.New(resource)
+
+	c := cursor{}
+	for _, key := range keys {
+		field, ok := last.FieldByName(key.column)
+		if !ok {
+			return "", ErrInvalidCursor
+		}
+		value, err := json.Marshal(field.Field.Interface())
+		if err != nil {
+			return "", err
 		}
+		c.Keys = append(c.Keys, key.String())
+		c.Values = append(c.Values, value)
 	}
 
-	if params.Include != nil {
-		for _, name := range params.Include {
-			qryDB = qryDB.Preload(strings.Title(name))
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// keysetQuery returns the where clause selecting records after the cursor:
+// (a > ?) OR (a = ? AND b > ?) OR ...
+func keysetQuery(scope *gorm.Scope, keys []orderKey, encoded string) (string, []interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, ErrInvalidCursor
+	}
+
+	c := cursor{}
+	if err = json.Unmarshal(data, &c); err != nil || len(c.Keys) != len(keys) || len(c.Values) != len(keys) {
+		return "", nil, ErrInvalidCursor
+	}
+
+	// Values are decoded with the type of the column
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if c.Keys[i] != key.String() {
+			// The order changed since the cursor was created
+			return "", nil, ErrInvalidCursor
+		}
+
+		field, _ := scope.FieldByName(key.column)
+		value := reflect.New(field.Struct.Type)
+		if err = json.Unmarshal(c.Values[i], value.Interface()); err != nil {
+			return "", nil, ErrInvalidCursor
 		}
+		values[i] = value.Elem().Interface()
 	}
 
-	// query the database
-	qryDB.Find(results)
+	var clauses []string
+	var args []interface{}
+	for i, key := range keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, fmt.Sprintf("%s = ?", keys[j].column))
+			args = append(args, values[j])
+		}
 
-	return nil
+		op := Sup
+		if key.desc {
+			op = Inf
+		}
+		parts = append(parts, fmt.Sprintf("%s %s ?", key.column, op))
+		args = append(args, values[i])
+
+		clauses = append(clauses, fmt.Sprintf("(%s)", strings.Join(parts, " AND ")))
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(clauses, " OR ")), args, nil
 }
 
 // HandleQuery retrieves results filtered by request parameters
@@ -157,7 +445,7 @@ func (g *Goal) handleQuery(rType reflect.Type, request *http.Request) (int, inte
 		return 500, nil, err
 	}
 
-	params := g.NewQueryParams()
+	params := g.requestQueryParams(request)
 	err = json.Unmarshal([]byte(query), &params)
 	if err != nil {
 		fmt.Println(err)
@@ -167,13 +455,34 @@ func (g *Goal) handleQuery(rType reflect.Type, request *http.Request) (int, inte
 	resource := newObjectWithType(rType)
 	results := dynamicSlice(resource)
 
+	// Let the database filter records user cannot read, so that
+	// limit and count stay correct
+	if readScope := g.readScope(rType, request); readScope != nil {
+		params.scopes = append(params.scopes, readScope)
+	}
+
+	// Restrict to the records user can access
+	policy, err := g.policyScope(rType, request)
+	if err != nil {
+		return 403, nil, err
+	}
+	if policy != nil {
+		params.scopes = append(params.scopes, policy)
+	}
+
+	// Invalid queries are errors of the client, others of the database
 	err = params.Find(resource, results)
+	if isQueryError(err) {
+		return 400, nil, err
+	}
 	if err != nil {
 		return 500, nil, err
 	}
 
-	// Check permission for each item, remove item which doesn't have permission
+	// Check permission for each item, remove item which doesn't have permission.
+	// Current user and its roles are only loaded once for all the items
 	var filtered []interface{}
+	roles := params.roles
 
 	switch reflect.TypeOf(results).Elem().Kind() {
 	case reflect.Slice:
@@ -181,7 +490,7 @@ func (g *Goal) handleQuery(rType reflect.Type, request *http.Request) (int, inte
 
 		for i := 0; i < s.Len(); i++ {
 			item := s.Index(i).Interface()
-			err = g.CanPerform(item, request, true)
+			err = roles.check(permittedRoles(item, ActionRead))
 
 			// Only add to the filtered slice if no permission error
 			if err == nil {
@@ -192,19 +501,37 @@ func (g *Goal) handleQuery(rType reflect.Type, request *http.Request) (int, inte
 		panic("results should be a slice")
 	}
 
+	if params.Envelope || params.Count || params.Cursor != nil {
+		page := queryPage{
+			Results: filtered,
+			Limit:   params.Limit,
+			Skip:    params.Skip,
+			Next:    params.next,
+		}
+		if page.Results == nil {
+			page.Results = []interface{}{}
+		}
+		if params.Count {
+			count, err := params.Total(resource)
+			if err != nil {
+				return 500, nil, err
+			}
+			page.Count = &count
+		}
+		return 200, page, nil
+	}
+
 	return 200, filtered, nil
 }
 
 func (item *QueryItem) getQuery(scope *gorm.Scope) (string, error) {
 	_, exists := allowedOps()[item.Op]
 	if !exists {
-		str := fmt.Sprintf("Invalid SQL operator: %s", item.Op)
-		return "", errors.New(str)
+		return "", queryErrorf("Invalid SQL operator: %s", item.Op)
 	}
 
 	if !scope.HasColumn(item.Key) {
-		str := fmt.Sprintf("Column does not exist: %s", item.Key)
-		return "", errors.New(str)
+		return "", queryErrorf("Column does not exist: %s", item.Key)
 	}
 
 	var query string
@@ -217,3 +544,195 @@ func (item *QueryItem) getQuery(scope *gorm.Scope) (string, error) {
 
 	return query, nil
 }
+
+// Match reports whether resource satisfies the where clauses of the query.
+// Items are connected by "AND", each item being true if itself or one of its
+// "or" items is true. It allows to filter a record without querying the database
+func (params *queryParams) Match(resource interface{}) (bool, error) {
+	scope := params.db.NewScope(resource)
+
+	for _, item := range params.Where {
+		if err := params.checkWhere(scope, item); err != nil {
+			return false, err
+		}
+
+		ok, err := item.match(scope)
+		if err != nil {
+			return false, err
+		}
+
+		for _, orItem := range item.Or {
+			if ok {
+				break
+			}
+			ok, err = orItem.match(scope)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (item *QueryItem) match(scope *gorm.Scope) (bool, error) {
+	// Use the same validation as the SQL query
+	if _, err := item.getQuery(scope); err != nil {
+		return false, err
+	}
+
+	field, ok := scope.FieldByName(item.Key)
+	if !ok {
+		str := fmt.Sprintf("Column does not exist: %s", item.Key)
+		return false, errors.New(str)
+	}
+
+	// A null value never matches, like in SQL
+	value := reflect.Indirect(field.Field)
+	if !value.IsValid() {
+		return false, nil
+	}
+	current := value.Interface()
+
+	switch item.Op {
+	case In:
+		values := reflect.ValueOf(item.Val)
+		if values.Kind() != reflect.Slice {
+			return false, fmt.Errorf("Invalid value for operator %s: %v", item.Op, item.Val)
+		}
+		for i := 0; i < values.Len(); i++ {
+			c, err := compareValues(current, values.Index(i).Interface())
+			if err == nil && c == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case Like:
+		return likeMatch(fmt.Sprint(current), fmt.Sprint(item.Val)), nil
+	}
+
+	c, err := compareValues(current, item.Val)
+	if err != nil {
+		return false, err
+	}
+
+	switch item.Op {
+	case Equal:
+		return c == 0, nil
+	case NotEq:
+		return c != 0, nil
+	case Sup:
+		return c > 0, nil
+	case SupEq:
+		return c >= 0, nil
+	case Inf:
+		return c < 0, nil
+	case InfEq:
+		return c <= 0, nil
+	}
+
+	return false, nil
+}
+
+// compareValues compares a column value with a query value, which
+// usually comes from json: numbers are float64 and dates are strings
+func compareValues(current interface{}, val interface{}) (int, error) {
+	if t, ok := current.(time.Time); ok {
+		var other time.Time
+		switch v := val.(type) {
+		case time.Time:
+			other = v
+		case string:
+			var err error
+			other, err = time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("Cannot compare date with %v", val)
+		}
+		switch {
+		case t.Before(other):
+			return -1, nil
+		case t.After(other):
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	if a, ok := toFloat(current); ok {
+		b, ok := toFloat(val)
+		if !ok {
+			s, isString := val.(string)
+			if !isString {
+				return 0, fmt.Errorf("Cannot compare number with %v", val)
+			}
+			var err error
+			b, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				return 0, err
+			}
+		}
+		switch {
+		case a < b:
+			return -1, nil
+		case a > b:
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	if a, ok := current.(bool); ok {
+		b, ok := val.(bool)
+		if !ok {
+			return 0, fmt.Errorf("Cannot compare boolean with %v", val)
+		}
+		if a == b {
+			return 0, nil
+		}
+		if !a {
+			return -1, nil
+		}
+		return 1, nil
+	}
+
+	return strings.Compare(fmt.Sprint(current), fmt.Sprint(val)), nil
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// likeMatch matches a value against a SQL LIKE pattern, case insensitive
+// as sqlite and mysql do by default
+func likeMatch(value string, pattern string) bool {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	matched, err := regexp.MatchString(expr.String(), value)
+	return err == nil && matched
+}
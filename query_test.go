@@ -1,6 +1,7 @@
 package goal
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -74,6 +75,29 @@ func TestSuccessQueryParamsFind(t *testing.T) {
 
 }
 
+func TestQueryParamsOrGrouping(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	createUsers()
+
+	// age > 25 AND (name = Thomas OR name = Jason), Jason is 22
+	params := g.NewQueryParams()
+	params.Where = []*QueryItem{
+		{Key: "age", Op: Sup, Val: 25},
+		{Key: "name", Op: Equal, Val: "Thomas", Or: []*QueryItem{{Key: "name", Op: Equal, Val: "Jason"}}},
+	}
+
+	var results []testuser
+	var user testuser
+	if err := params.Find(&user, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "Thomas" {
+		t.Error("Error: or items should only apply to their item. Got: ", results)
+	}
+}
+
 func TestSuccessQueryBuilderFind(t *testing.T) {
 	setup()
 	defer tearDown()
@@ -185,3 +209,210 @@ func TestQueryViaAPI(t *testing.T) {
 		t.Error("Error: query should return 1 result. Got : ", results)
 	}
 }
+
+func TestQueryParamsMatch(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	user := &testuser{Name: "Thomas", Age: 28}
+
+	params := g.NewQueryParams()
+	params.Where = []*QueryItem{
+		{Key: "name", Op: Like, Val: "tho%", Or: []*QueryItem{{Key: "name", Op: Equal, Val: "Alan"}}},
+		{Key: "age", Op: Sup, Val: float64(20)},
+	}
+
+	ok, err := params.Match(user)
+	if err != nil || !ok {
+		t.Error("Error: user should match the query", err)
+	}
+
+	user.Name = "Alan"
+	ok, err = params.Match(user)
+	if err != nil || !ok {
+		t.Error("Error: user should match the or clause", err)
+	}
+
+	user.Age = 18
+	ok, err = params.Match(user)
+	if err != nil || ok {
+		t.Error("Error: user should not match the query", err)
+	}
+
+	params.Where = []*QueryItem{{Key: "age", Op: In, Val: []interface{}{float64(18), float64(30)}}}
+	ok, err = params.Match(user)
+	if err != nil || !ok {
+		t.Error("Error: user should match the in clause", err)
+	}
+
+	params.Where = []*QueryItem{{Key: "hello", Op: Equal, Val: "Thomas"}}
+	if _, err = params.Match(user); err == nil {
+		t.Error("Error: query column should be invalid")
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	createUsers()
+	g.db.Create(&testuser{Name: "Zoe", Age: 30})
+
+	var user testuser
+	var names []string
+	q := g.NewQuery().Where("age").SupEq(25).Order("age", Desc, false).Limit(2).After("")
+	for i := 0; i < 3; i++ {
+		var results []testuser
+		if err := q.Find(&user, &results); err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			names = append(names, result.Name)
+		}
+		if q.Next() == "" {
+			break
+		}
+		q.After(q.Next())
+	}
+
+	// Alan and Zoe have the same age, they are sorted by id
+	expected := []string{"Ben", "Alan", "Zoe", "Thomas"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Error("Error: cursor should return all results in order. Got: ", names)
+	}
+
+	// Cursor is returned by the API
+	params := g.NewQueryParams()
+	params.Limit = 3
+	params.Order = map[string]bool{"name": false}
+	cursor := ""
+	params.Cursor = &cursor
+
+	query, _ := json.Marshal(params)
+	res, err := http.Get(queryPath(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var page struct {
+		Results []testuser
+		Next    string
+	}
+	json.NewDecoder(res.Body).Decode(&page)
+	if len(page.Results) != 3 || page.Results[0].Name != "Alan" || page.Next == "" {
+		t.Error("Error: query should return first page with a cursor. Got: ", page)
+	}
+
+	// Malformed cursor is a bad request
+	bad := base64.RawURLEncoding.EncodeToString([]byte(`{"k":["name ASC","id ASC"],"v":["Alan","x"]}`))
+	params.Cursor = &bad
+	query, _ = json.Marshal(params)
+	res, err = http.Get(queryPath(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Error("Error: malformed cursor should be a bad request. Got: ", res.StatusCode)
+	}
+
+	// Invalid cursor
+	params.Order = map[string]bool{"age": false}
+	params.Cursor = &page.Next
+	var results []testuser
+	if err = params.Find(&user, &results); err != ErrInvalidCursor {
+		t.Error("Error: cursor should be invalid when order changes. Got: ", err)
+	}
+
+	// Errors of the database are not errors of the client
+	g.db.DropTable(&testuser{})
+	res, err = http.Get(queryPath([]byte(`{}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 500 {
+		t.Error("Error: database error should be a server error. Got: ", res.StatusCode)
+	}
+}
+
+func TestQueryHiddenOrder(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	createUsers()
+
+	// Cursor would contain the password hashes
+	query := []byte(`{"limit": 1, "cursor": "", "order": {"password": false}}`)
+	res, err := http.Get(queryPath(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		t.Error("Error: query should not be ordered by password")
+	}
+
+	// Server side queries can use any column
+	var user testuser
+	var results []testuser
+	if err = g.NewQuery().Where("age").Sup(0).Order("password", Asc, false).Find(&user, &results); err != nil {
+		t.Error("Error: query builder should order by any column. Got: ", err)
+	}
+}
+
+func TestQueryHiddenWhere(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	createUsers()
+
+	// Clients could guess the password hashes
+	for _, query := range []string{
+		`{"where": [{"key": "password", "op": ">=", "val": "$2a$"}]}`,
+		`{"where": [{"key": "name", "op": "=", "val": "Thomas", "or": [{"key": "password", "op": ">", "val": "$"}]}]}`,
+	} {
+		res, err := http.Get(queryPath([]byte(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Error("Error: query should not filter on password. Got: ", res.StatusCode)
+		}
+	}
+}
+
+func TestQueryEnvelope(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	for _, title := range []string{"First", "Second", "Secret"} {
+		art := &article{Title: title}
+		if title == "Secret" {
+			art.Permission = Permission{Read: `["admin"]`}
+		}
+		g.db.Create(art)
+	}
+
+	query := []byte(`{"limit": 10, "count": true}`)
+	res, err := http.Get(fmt.Sprint(testServer.URL, "/query/article/", url.QueryEscape(string(query))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var page struct {
+		Results []article
+		Count   *int64
+		Limit   int64
+		Skip    int64
+	}
+	json.NewDecoder(res.Body).Decode(&page)
+
+	// Secret article is filtered out by the database
+	if len(page.Results) != 2 || page.Count == nil || *page.Count != 2 || page.Limit != 10 {
+		t.Error("Error: query should return 2 results out of 2. Got: ", page)
+	}
+}
@@ -6,6 +6,7 @@ package goal
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -86,6 +87,30 @@ func (r *RedisCache) Set(key string, val interface{}) error {
 	return err
 }
 
+// SetWithTTL sets a val for a key into Redis, which expires after ttl
+func (r *RedisCache) SetWithTTL(key string, val interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return r.Set(key, val)
+	}
+
+	conn, err := r.pool.Dial()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	defer conn.Close()
+
+	var data []byte
+	data, err = json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", key, data, "PX", ttl.Milliseconds())
+	return err
+}
+
 // Delete a key from Redis
 func (r *RedisCache) Delete(key string) error {
 	conn, err := r.pool.Dial()
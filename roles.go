@@ -0,0 +1,262 @@
+// roles stores roles in database. A role can include other roles, its
+// users are then given the included roles too: admin includes editor,
+// which includes viewer, so admins are also editors and viewers
+
+package goal
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Role is a named group of users stored in database
+type Role struct {
+	Name string `gorm:"primary_key" json:"name"`
+}
+
+func (Role) TableName() string {
+	return "goal_roles"
+}
+
+// roleInclude gives the included role to the users of role
+type roleInclude struct {
+	Role     string `gorm:"primary_key"`
+	Included string `gorm:"primary_key"`
+}
+
+func (roleInclude) TableName() string {
+	return "goal_role_includes"
+}
+
+// roleMember gives the role to an user, identified by its own role
+type roleMember struct {
+	Role   string `gorm:"primary_key"`
+	Member string `gorm:"primary_key"`
+}
+
+func (roleMember) TableName() string {
+	return "goal_role_members"
+}
+
+var (
+	ErrEmptyRole   = errors.New("role cannot be empty")
+	ErrUnknownRole = errors.New("unknown role")
+	ErrRoleCycle   = errors.New("role cannot include itself")
+)
+
+// roleIncludesCacheKey is the cache key of the whole role hierarchy
+const roleIncludesCacheKey = "goal_roles:includes"
+
+// roleMembersCacheKey returns the cache key of the roles given to member
+func roleMembersCacheKey(member string) string {
+	return defaultCacheKey("goal_roles:members", member)
+}
+
+// ownRole returns the role every user has, made of its table
+// and primary key: "testuser:1"
+func (g *Goal) ownRole(user interface{}) string {
+	return defaultCacheKey(g.tableName(user), g.db.NewScope(user).PrimaryKeyValue())
+}
+
+// CreateRole stores the role, including the given roles which must exist
+func (g *Goal) CreateRole(name string, includes ...string) error {
+	if name == "" {
+		return ErrEmptyRole
+	}
+	if err := g.db.Save(&Role{Name: name}).Error; err != nil {
+		return err
+	}
+	for _, included := range includes {
+		if err := g.IncludeRole(name, included); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRole removes the role, from the roles including it and from its users
+func (g *Goal) DeleteRole(name string) error {
+	var members []roleMember
+	if err := g.db.Where("role = ?", name).Find(&members).Error; err != nil {
+		return err
+	}
+
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role = ? OR included = ?", name, name).Delete(&roleInclude{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role = ?", name).Delete(&roleMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("name = ?", name).Delete(&Role{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	g.uncacheKey(roleIncludesCacheKey)
+	for _, m := range members {
+		g.uncacheKey(roleMembersCacheKey(m.Member))
+	}
+	return nil
+}
+
+// IncludeRole gives the included role to the users of role
+func (g *Goal) IncludeRole(role string, included string) error {
+	if err := g.checkRoleExists(role, included); err != nil {
+		return err
+	}
+
+	// included must not give role back
+	inherited, err := g.expandRoles([]string{included})
+	if err != nil {
+		return err
+	}
+	for _, r := range inherited {
+		if r == role {
+			return ErrRoleCycle
+		}
+	}
+
+	if err = g.db.Save(&roleInclude{Role: role, Included: included}).Error; err != nil {
+		return err
+	}
+	g.uncacheKey(roleIncludesCacheKey)
+	return nil
+}
+
+// ExcludeRole stops giving the included role to the users of role
+func (g *Goal) ExcludeRole(role string, included string) error {
+	err := g.db.Where("role = ? AND included = ?", role, included).Delete(&roleInclude{}).Error
+	if err != nil {
+		return err
+	}
+	g.uncacheKey(roleIncludesCacheKey)
+	return nil
+}
+
+// AddUserRole gives the role to the user
+func (g *Goal) AddUserRole(user interface{}, role string) error {
+	if err := g.checkRoleExists(role); err != nil {
+		return err
+	}
+
+	member := g.ownRole(user)
+	if err := g.db.Save(&roleMember{Role: role, Member: member}).Error; err != nil {
+		return err
+	}
+	g.uncacheKey(roleMembersCacheKey(member))
+	return nil
+}
+
+// RemoveUserRole takes the role back from the user
+func (g *Goal) RemoveUserRole(user interface{}, role string) error {
+	member := g.ownRole(user)
+	err := g.db.Where("role = ? AND member = ?", role, member).Delete(&roleMember{}).Error
+	if err != nil {
+		return err
+	}
+	g.uncacheKey(roleMembersCacheKey(member))
+	return nil
+}
+
+// UserRoles returns all the roles of the user, including the inherited ones.
+// Users implementing Roler define their own roles, the others have their
+// own role and the roles given in database
+func (g *Goal) UserRoles(user interface{}) ([]string, error) {
+	var roles []string
+	if roler, ok := user.(Roler); ok {
+		roles = roler.Roles()
+	} else {
+		member := g.ownRole(user)
+		members, err := g.roleMembers(member)
+		if err != nil {
+			return []string{member}, err
+		}
+		roles = append([]string{member}, members...)
+	}
+
+	expanded, err := g.expandRoles(roles)
+	if err != nil {
+		return roles, err
+	}
+	return expanded, nil
+}
+
+// expandRoles returns the roles and all the roles they include
+func (g *Goal) expandRoles(roles []string) ([]string, error) {
+	includes, err := g.roleIncludes()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var expanded []string
+	for len(roles) > 0 {
+		role := roles[0]
+		roles = roles[1:]
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+		expanded = append(expanded, role)
+		roles = append(roles, includes[role]...)
+	}
+	return expanded, nil
+}
+
+// roleIncludes returns the roles included by each role,
+// from cacher or from database
+func (g *Goal) roleIncludes() (map[string][]string, error) {
+	includes := map[string][]string{}
+	if g.getCached(roleIncludesCacheKey, &includes) {
+		return includes, nil
+	}
+
+	var records []roleInclude
+	if err := g.db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		includes[r.Role] = append(includes[r.Role], r.Included)
+	}
+
+	g.setCached(roleIncludesCacheKey, includes)
+	return includes, nil
+}
+
+// roleMembers returns the roles given to member in database,
+// from cacher or from database
+func (g *Goal) roleMembers(member string) ([]string, error) {
+	key := roleMembersCacheKey(member)
+	roles := []string{}
+	if g.getCached(key, &roles) {
+		return roles, nil
+	}
+
+	var records []roleMember
+	if err := g.db.Where("member = ?", member).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		roles = append(roles, r.Role)
+	}
+
+	g.setCached(key, roles)
+	return roles, nil
+}
+
+// checkRoleExists returns ErrUnknownRole if one of the roles is not stored
+func (g *Goal) checkRoleExists(roles ...string) error {
+	for _, name := range roles {
+		var count int
+		if err := g.db.Model(&Role{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUnknownRole
+		}
+	}
+	return nil
+}
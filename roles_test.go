@@ -0,0 +1,105 @@
+package goal
+
+import (
+	"reflect"
+	"testing"
+)
+
+// member is an user model which does not implement Roler
+type member struct {
+	ID   uint `gorm:"primary_key"`
+	Name string
+}
+
+func TestRoles(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	// Resolved roles are cached
+	g.cacher = NewMemoryCache()
+
+	g.db.AutoMigrate(&member{})
+	m := &member{Name: "Adphi"}
+	g.db.Create(m)
+
+	if err := g.CreateRole("viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateRole("editor", "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateRole("admin", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateRole("reviewer", "nobody"); err != ErrUnknownRole {
+		t.Error("Unknown role should not be included. Got: ", err)
+	}
+	if err := g.IncludeRole("viewer", "admin"); err != ErrRoleCycle {
+		t.Error("Role should not include itself. Got: ", err)
+	}
+
+	roles, err := g.UserRoles(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roles, []string{"member:1"}) {
+		t.Error("User should only have its own role. Got: ", roles)
+	}
+
+	if err = g.AddUserRole(m, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	roles, _ = g.UserRoles(m)
+	if !reflect.DeepEqual(roles, []string{"member:1", "admin", "editor", "viewer"}) {
+		t.Error("Admin should inherit editor and viewer roles. Got: ", roles)
+	}
+
+	// Changes invalidate the cache
+	g.ExcludeRole("editor", "viewer")
+	roles, _ = g.UserRoles(m)
+	if !reflect.DeepEqual(roles, []string{"member:1", "admin", "editor"}) {
+		t.Error("Editor should not include viewer. Got: ", roles)
+	}
+
+	g.RemoveUserRole(m, "admin")
+	roles, _ = g.UserRoles(m)
+	if !reflect.DeepEqual(roles, []string{"member:1"}) {
+		t.Error("User should not be admin. Got: ", roles)
+	}
+
+	// Roler users inherit the roles included by theirs
+	g.CreateRole("testuser:1", "editor")
+	roles, _ = g.UserRoles(&testuser{ID: 1})
+	if !reflect.DeepEqual(roles, []string{"testuser:1", "editor"}) {
+		t.Error("Roler user should inherit editor. Got: ", roles)
+	}
+
+	g.DeleteRole("editor")
+	roles, _ = g.UserRoles(&testuser{ID: 1})
+	if !reflect.DeepEqual(roles, []string{"testuser:1"}) {
+		t.Error("Deleted role should not be inherited. Got: ", roles)
+	}
+}
+
+func TestRolesClassPermissions(t *testing.T) {
+	setup()
+	defer tearDown()
+
+	_, cookie := registerUser(t, "Adphi")
+
+	g.CreateRole("editor")
+	g.CreateRole("admin", "editor")
+	g.SetClassPermissions(&article{}, ClassPermissions{
+		ActionCreate: {Roles: []string{"editor"}},
+	})
+
+	if res := do("POST", "/article", `{"Title": "News"}`, cookie); res.Code != 403 {
+		t.Error("Only editors should create articles. Got: ", res.Code)
+	}
+
+	// Adphi's own role includes admin
+	g.CreateRole("testuser:1", "admin")
+	if res := do("POST", "/article", `{"Title": "News"}`, cookie); res.Code != 200 {
+		t.Error("Admin should create articles as editor. Got: ", res.Code)
+	}
+}
@@ -2,13 +2,71 @@ package goal
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
+
+	"github.com/gorilla/sessions"
 )
 
-// SetUserModel lets goal which model act as user
-func (g *Goal) SetUserModel(user interface{}) {
+// UserOption configures the user model
+type UserOption func(*Goal)
+
+// UsernameColumn sets the column of the username, "username" by default
+func UsernameColumn(column string) UserOption {
+	return func(g *Goal) {
+		g.c.usernameColumn = column
+	}
+}
+
+// PasswordColumn sets the column of the password hash, "password" by default
+func PasswordColumn(column string) UserOption {
+	return func(g *Goal) {
+		g.c.passwordColumn = column
+	}
+}
+
+// SetUserModel lets goal which model act as user. The columns are
+// used by the default auth handlers
+func (g *Goal) SetUserModel(user interface{}, options ...UserOption) {
 	g.userType = reflect.TypeOf(user).Elem()
+	g.c.usernameColumn = "username"
+	g.c.passwordColumn = "password"
+	for _, o := range options {
+		o(g)
+	}
+}
+
+// passwordField returns the name of the struct field holding the
+// password of the user model, or an empty string
+func (g *Goal) passwordField() string {
+	if g.userType == nil || g.c.passwordColumn == "" {
+		return ""
+	}
+	field, ok := g.db.NewScope(reflect.New(g.userType).Interface()).FieldByName(g.c.passwordColumn)
+	if !ok {
+		return ""
+	}
+	return field.Name
+}
+
+// redactPassword returns a copy of the user without its password,
+// other values are returned as is
+func (g *Goal) redactPassword(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Type() != g.userType {
+		return value
+	}
+	password := g.passwordField()
+	if password == "" {
+		return value
+	}
+
+	redacted := reflect.New(g.userType)
+	redacted.Elem().Set(v.Elem())
+	field := redacted.Elem().FieldByName(password)
+	field.Set(reflect.Zero(field.Type()))
+	return redacted.Interface()
 }
 
 // getUserResource returns a new variable based on reflection
@@ -21,6 +79,16 @@ func (g *Goal) getUserResource() (interface{}, error) {
 	return reflect.New(g.userType).Interface(), nil
 }
 
+// SessionError is returned when the credentials of the user are
+// correct, but its session could not be set
+type SessionError struct {
+	Err error
+}
+
+func (e *SessionError) Error() string {
+	return "unable to set user session: " + e.Err.Error()
+}
+
 // SetUserSession sets current user to session
 func (g *Goal) setUserSession(w http.ResponseWriter, req *http.Request, user interface{}) error {
 	session, err := g.session.Get(req, g.c.sessionName)
@@ -30,24 +98,44 @@ func (g *Goal) setUserSession(w http.ResponseWriter, req *http.Request, user int
 
 	scope := g.db.NewScope(user)
 
+	// Store the login server side, so it can be revoked
+	userSession, refreshToken, err := g.startSession(req, user)
+	if err != nil {
+		return err
+	}
+
 	// Set some session values.
 	session.Values[g.c.sessionKey] = scope.PrimaryKeyValue()
+	session.Values[sessionIDKey] = userSession.ID
 
 	// Save it before we write to the response/return from the handler.
+	// The server side session is not usable without the cookie
 	err = session.Save(req, w)
-	return err
+	if err != nil {
+		g.RevokeSession(userSession.ID)
+		return err
+	}
+
+	// Clients without cookies use the access and refresh tokens
+	w.Header().Set(RefreshTokenHeader, refreshToken)
+	return g.setAccessToken(w, userSession)
 }
 
-// GetCurrentUser returns current user based on the request header
-func (g *Goal) getCurrentUser(req *http.Request) (interface{}, error) {
-	session, err := g.session.Get(req, g.c.sessionName)
+// currentUserID returns the id of current user, from its server side
+// session which must not be revoked
+func (g *Goal) currentUserID(req *http.Request) (interface{}, error) {
+	session, err := g.currentSession(req)
 	if err != nil {
 		return nil, err
 	}
+	return session.UserID, nil
+}
 
-	userID, ok := session.Values[g.c.sessionKey]
-	if !ok {
-		return nil, errors.New("empty session")
+// GetCurrentUser returns current user based on the request header
+func (g *Goal) getCurrentUser(req *http.Request) (interface{}, error) {
+	userID, err := g.currentUserID(req)
+	if err != nil {
+		return nil, err
 	}
 
 	var user interface{}
@@ -72,15 +160,29 @@ func (g *Goal) getCurrentUser(req *http.Request) (interface{}, error) {
 
 	// If data not exists in Redis, load from database
 	if !exists {
-		err = g.db.First(user, userID).Error
+		key := fmt.Sprintf("%s = ?", g.db.NewScope(user).PrimaryKey())
+		err = g.db.Where(key, userID).First(user).Error
 		return user, err
 	}
 
 	return nil, errors.New("invalid session data")
 }
 
-// clearUserSession removes the current user from session
-func clearUserSession(w http.ResponseWriter, req *http.Request) error {
-	http.SetCookie(w, nil)
-	return nil
+// clearUserSession removes the current user from session and
+// expires the session cookie
+func (g *Goal) clearUserSession(w http.ResponseWriter, req *http.Request) error {
+	// A new session is returned with the error if the cookie is invalid
+	session, err := g.session.Get(req, g.c.sessionName)
+	if session == nil {
+		return err
+	}
+
+	delete(session.Values, g.c.sessionKey)
+	delete(session.Values, sessionIDKey)
+	if session.Options == nil {
+		session.Options = &sessions.Options{Path: "/"}
+	}
+	session.Options.MaxAge = -1
+
+	return session.Save(req, w)
 }
@@ -0,0 +1,444 @@
+// totp adds time-based one-time passwords (RFC 6238) as a second factor
+// of the user model. Once enabled, login returns a challenge exchanged
+// for a session with a code of the authenticator app or a recovery code:
+// POST /auth/totp/enroll
+// POST /auth/totp/verify {"code": "..."}
+// POST /auth/totp/disable {"code": "..."}
+// POST /auth/totp/login {"challenge": "...", "code": "..."}
+
+package goal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// totpPeriod is the lifetime of a code
+	totpPeriod = 30
+	// totpDigits is the length of a code
+	totpDigits = 6
+	// totpSkew is the number of periods accepted before and after
+	// current one, for clocks out of sync
+	totpSkew = 1
+	// totpChallengeExpiry is the time to send a code after the password
+	totpChallengeExpiry = 5 * time.Minute
+	// recoveryCodesCount is the number of recovery codes of an user
+	recoveryCodesCount = 10
+)
+
+const purposeTOTP tokenPurpose = "totp"
+
+// userTOTP is the second factor of an user, enabled once a first code
+// is verified
+type userTOTP struct {
+	UserID    string `gorm:"primary_key"`
+	Secret    string
+	Enabled   bool
+	CreatedAt time.Time
+	// LastStep is the period of the last accepted code, a code
+	// cannot be used twice
+	LastStep int64
+}
+
+func (userTOTP) TableName() string {
+	return "goal_totp"
+}
+
+// recoveryCode replaces a code once, only its hash is stored
+type recoveryCode struct {
+	Hash   string `gorm:"primary_key"`
+	UserID string `gorm:"index"`
+	UsedAt *time.Time
+}
+
+func (recoveryCode) TableName() string {
+	return "goal_recovery_codes"
+}
+
+// SecondFactorChallenge is returned by login when the user enabled TOTP
+type SecondFactorChallenge struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// totpEnrollment is returned when an user starts enrolling
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+var (
+	ErrSecondFactorRequired = errors.New("second factor required")
+	ErrInvalidTOTPCode      = errors.New("invalid two-factor code")
+	ErrTOTPEnabled          = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled      = errors.New("two-factor authentication is not enrolled")
+)
+
+// WithTOTPIssuer sets the issuer shown by authenticator apps, "goal" by default
+func WithTOTPIssuer(issuer string) Option {
+	return func(goal *Goal) error {
+		if issuer != "" {
+			goal.c.totpIssuer = issuer
+		}
+		return nil
+	}
+}
+
+// totpCode returns the code of the secret for a period
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStep returns the period of a time
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// matchTOTP returns the period of the code if it is valid at now and
+// more recent than the last accepted one
+func matchTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpURI returns the provisioning URI scanned by authenticator apps
+func totpURI(issuer string, account string, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// userID returns the primary key of the user as stored by goal tables
+func (g *Goal) userID(user interface{}) string {
+	return fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue())
+}
+
+// totpOf returns the second factor of the user, or nil
+func (g *Goal) totpOf(userID string) (*userTOTP, error) {
+	totp := &userTOTP{}
+	err := g.db.Where("user_id = ?", userID).First(totp).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	return totp, err
+}
+
+// IsTOTPEnabled reports whether the user needs a second factor to login
+func (g *Goal) IsTOTPEnabled(user interface{}) (bool, error) {
+	totp, err := g.totpOf(g.userID(user))
+	if err != nil {
+		return false, err
+	}
+	return totp != nil && totp.Enabled, nil
+}
+
+// secondFactorChallenge returns a challenge if the user enabled TOTP
+func (g *Goal) secondFactorChallenge(user interface{}) (*SecondFactorChallenge, error) {
+	enabled, err := g.IsTOTPEnabled(user)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	token, err := g.issueAuthToken(user, purposeTOTP, totpChallengeExpiry)
+	if err != nil {
+		return nil, err
+	}
+	return &SecondFactorChallenge{Challenge: token, ExpiresAt: time.Now().Add(totpChallengeExpiry)}, nil
+}
+
+// useTOTPCode accepts a code of the authenticator app once
+func (g *Goal) useTOTPCode(totp *userTOTP, code string) (bool, error) {
+	secret, err := totpEncoding.DecodeString(totp.Secret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTOTP(secret, code, time.Now(), totp.LastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// The update fails if the code was used meanwhile
+	result := g.db.Model(&userTOTP{}).Where("user_id = ? AND last_step < ?", totp.UserID, step).
+		Update("last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// normalizeRecoveryCode ignores the case and separators of a recovery code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// useRecoveryCode accepts a recovery code of the user once
+func (g *Goal) useRecoveryCode(userID string, code string) (bool, error) {
+	result := g.db.Model(&recoveryCode{}).
+		Where("hash = ? AND user_id = ? AND used_at IS NULL", hashToken(normalizeRecoveryCode(code)), userID).
+		Update("used_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
+
+// useSecondFactor accepts a code of the authenticator app or a recovery code
+func (g *Goal) useSecondFactor(totp *userTOTP, code string) (bool, error) {
+	if len(code) == totpDigits {
+		return g.useTOTPCode(totp, code)
+	}
+	return g.useRecoveryCode(totp.UserID, code)
+}
+
+// newRecoveryCodes replaces the recovery codes of the user
+func (g *Goal) newRecoveryCodes(userID string) ([]string, error) {
+	if err := g.db.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+
+		record := &recoveryCode{Hash: hashToken(normalizeRecoveryCode(code)), UserID: userID}
+		if err := g.db.Create(record).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// sessionUser returns the server side session and the user of the request
+func (g *Goal) sessionUser(request *http.Request) (*UserSession, interface{}, error) {
+	session, err := g.currentSession(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := g.userByID(session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, user, nil
+}
+
+// totpEnrollHandler generates a new secret for current user, enabled
+// once a first code is verified
+func (g *Goal) totpEnrollHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	if request.Method != http.MethodPost {
+		return 405, nil, http.ErrNotSupported
+	}
+	_, user, err := g.sessionUser(request)
+	if err != nil {
+		return 401, nil, err
+	}
+
+	userID := g.userID(user)
+	totp, err := g.totpOf(userID)
+	if err != nil {
+		return 500, nil, err
+	}
+	if totp != nil && totp.Enabled {
+		return 409, nil, ErrTOTPEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err = rand.Read(key); err != nil {
+		return 500, nil, err
+	}
+	secret := totpEncoding.EncodeToString(key)
+	if err = g.db.Save(&userTOTP{UserID: userID, Secret: secret, CreatedAt: time.Now()}).Error; err != nil {
+		return 500, nil, err
+	}
+	return 200, &totpEnrollment{Secret: secret, URI: totpURI(g.c.totpIssuer, g.username(user), secret)}, nil
+}
+
+// totpVerifyHandler enables TOTP of current user with a first code,
+// and returns its recovery codes
+func (g *Goal) totpVerifyHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	values, err := decodeValues(request)
+	if err != nil {
+		return valuesCode(err), nil, err
+	}
+	_, user, err := g.sessionUser(request)
+	if err != nil {
+		return 401, nil, err
+	}
+
+	totp, err := g.totpOf(g.userID(user))
+	if err != nil {
+		return 500, nil, err
+	}
+	if totp == nil {
+		return 404, nil, ErrTOTPNotEnrolled
+	}
+	if totp.Enabled {
+		return 409, nil, ErrTOTPEnabled
+	}
+
+	ok, err := g.useTOTPCode(totp, values["code"])
+	if err != nil {
+		return 500, nil, err
+	}
+	if !ok {
+		return 400, nil, ErrInvalidTOTPCode
+	}
+
+	if err = g.db.Model(totp).Update("enabled", true).Error; err != nil {
+		return 500, nil, err
+	}
+	codes, err := g.newRecoveryCodes(totp.UserID)
+	if err != nil {
+		return 500, nil, err
+	}
+	return 200, map[string][]string{"recovery_codes": codes}, nil
+}
+
+// totpDisableHandler disables TOTP of current user with a code or
+// a recovery code. Wrong codes count as failed logins, so that a stolen
+// session cannot guess them
+func (g *Goal) totpDisableHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	values, err := decodeValues(request)
+	if err != nil {
+		return valuesCode(err), nil, err
+	}
+	_, user, err := g.sessionUser(request)
+	if err != nil {
+		return 401, nil, err
+	}
+
+	username := g.username(user)
+	if until := g.lockedUntil(username, request); !until.IsZero() {
+		setRetryAfter(rw, until)
+		return 429, nil, ErrTooManyAttempts
+	}
+
+	totp, err := g.totpOf(g.userID(user))
+	if err != nil {
+		return 500, nil, err
+	}
+	if totp == nil || !totp.Enabled {
+		return 404, nil, ErrTOTPNotEnrolled
+	}
+
+	ok, err := g.useSecondFactor(totp, values["code"])
+	if err != nil {
+		return 500, nil, err
+	}
+	if !ok {
+		g.loginFailed(username, request)
+		return 400, nil, ErrInvalidTOTPCode
+	}
+	g.loginSucceeded(username, request)
+
+	if err = g.db.Delete(totp).Error; err != nil {
+		return 500, nil, err
+	}
+	if err = g.db.Where("user_id = ?", totp.UserID).Delete(&recoveryCode{}).Error; err != nil {
+		return 500, nil, err
+	}
+	return 200, nil, nil
+}
+
+// totpLoginHandler exchanges the challenge of login and a code for
+// a session. Wrong codes count as failed logins
+func (g *Goal) totpLoginHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	values, err := decodeValues(request)
+	if err != nil {
+		return valuesCode(err), nil, err
+	}
+
+	record, user, err := g.findAuthToken(values["challenge"], purposeTOTP)
+	if err == ErrInvalidAuthToken {
+		return 401, nil, err
+	}
+	if err != nil {
+		return 500, nil, err
+	}
+
+	username := g.username(user)
+	if until := g.lockedUntil(username, request); !until.IsZero() {
+		setRetryAfter(rw, until)
+		return 429, nil, ErrTooManyAttempts
+	}
+
+	totp, err := g.totpOf(record.UserID)
+	if err != nil {
+		return 500, nil, err
+	}
+	if totp == nil || !totp.Enabled {
+		return 401, nil, ErrTOTPNotEnrolled
+	}
+
+	ok, err := g.useSecondFactor(totp, values["code"])
+	if err != nil {
+		return 500, nil, err
+	}
+	if !ok {
+		g.loginFailed(username, request)
+		return 401, nil, ErrInvalidTOTPCode
+	}
+	g.loginSucceeded(username, request)
+
+	if err = g.consumeAuthToken(record); err != nil {
+		return 401, nil, err
+	}
+	if err = g.setUserSession(rw, request, user); err != nil {
+		return 500, nil, err
+	}
+	return 200, user, nil
+}
+
+// AddTOTPPaths lets users enable TOTP and login with a second factor
+func (g *Goal) AddTOTPPaths() {
+	paths := map[string]simpleResponse{
+		"/auth/totp/enroll":  g.totpEnrollHandler,
+		"/auth/totp/verify":  g.totpVerifyHandler,
+		"/auth/totp/disable": g.totpDisableHandler,
+		"/auth/totp/login":   g.totpLoginHandler,
+	}
+	for path, handler := range paths {
+		handler := handler
+		g.mux.HandleFunc(path, func(rw http.ResponseWriter, request *http.Request) {
+			g.renderJSON(rw, request, handler)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package goal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	}
+	for seconds, code := range vectors {
+		if got := totpCode(secret, totpStep(time.Unix(seconds, 0))); got != code {
+			t.Errorf("Code at %d should be %s. Got: %s", seconds, code, got)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	step := totpStep(now)
+	if _, ok := matchTOTP(secret, totpCode(secret, step-1), now, 0); !ok {
+		t.Error("Previous code should be accepted")
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, step-2), now, 0); ok {
+		t.Error("Old code should be rejected")
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, step), now, step); ok {
+		t.Error("Used code should be rejected")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	ng, serve := setupAccounts(t, WithTOTPIssuer("My App"))
+	defer ng.Close()
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	res := serve("POST", "/auth/register", body, "")
+	cookie := res.Header().Get("Set-Cookie")
+
+	if res = serve("POST", "/auth/totp/enroll", "", ""); res.Code != 401 {
+		t.Error("Anonymous user should not enroll. Got: ", res.Code)
+	}
+	res = serve("POST", "/auth/totp/enroll", "", cookie)
+	var enrollment totpEnrollment
+	if err := json.Unmarshal(res.Body.Bytes(), &enrollment); err != nil || res.Code != 200 {
+		t.Fatal("User should enroll. Got: ", res.Code, res.Body.String())
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/My%20App:adphi@example.com?") ||
+		!strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Error("Provisioning URI should contain the secret. Got: ", enrollment.URI)
+	}
+	secret, _ := totpEncoding.DecodeString(enrollment.Secret)
+	step := totpStep(time.Now())
+
+	// Enrolled secret is not enabled until verified
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 200 {
+		t.Error("User should login without second factor. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/totp/verify", `{"code": "000000x"}`, cookie); res.Code != 400 {
+		t.Error("Wrong code should be rejected. Got: ", res.Code)
+	}
+	res = serve("POST", "/auth/totp/verify", `{"code": "`+totpCode(secret, step)+`"}`, cookie)
+	var codes struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &codes); err != nil || res.Code != 200 || len(codes.RecoveryCodes) != recoveryCodesCount {
+		t.Fatal("TOTP should be enabled. Got: ", res.Code, res.Body.String())
+	}
+	if res = serve("POST", "/auth/totp/enroll", "", cookie); res.Code != 409 {
+		t.Error("Enabled TOTP should not be enrolled again. Got: ", res.Code)
+	}
+
+	// Login returns a challenge instead of a session
+	login := func() string {
+		res := serve("POST", "/auth/login", body, "")
+		var challenge struct {
+			Message string
+			Data    SecondFactorChallenge
+		}
+		json.Unmarshal(res.Body.Bytes(), &challenge)
+		if res.Code != 401 || res.Header().Get("Set-Cookie") != "" || challenge.Data.Challenge == "" {
+			t.Fatal("Login should require a second factor. Got: ", res.Code, res.Body.String())
+		}
+		return challenge.Data.Challenge
+	}
+	challenge := login()
+
+	if res = serve("POST", "/auth/totp/login", `{"challenge": "`+challenge+`", "code": "`+totpCode(secret, step)+`"}`, ""); res.Code != 401 {
+		t.Error("Code should not be used twice. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/totp/login", `{"challenge": "wrong", "code": "`+totpCode(secret, step+1)+`"}`, ""); res.Code != 401 {
+		t.Error("Wrong challenge should be rejected. Got: ", res.Code)
+	}
+	res = serve("POST", "/auth/totp/login", `{"challenge": "`+challenge+`", "code": "`+totpCode(secret, step+1)+`"}`, "")
+	if res.Code != 200 || res.Header().Get("Set-Cookie") == "" {
+		t.Fatal("User should login with a code. Got: ", res.Code, res.Body.String())
+	}
+	if res = serve("POST", "/auth/totp/login", `{"challenge": "`+challenge+`", "code": "`+codes.RecoveryCodes[0]+`"}`, ""); res.Code != 401 {
+		t.Error("Challenge should not be used twice. Got: ", res.Code)
+	}
+
+	// Recovery codes can be used once
+	recovery := `{"challenge": "` + login() + `", "code": "` + strings.ToUpper(codes.RecoveryCodes[0]) + `"}`
+	if res = serve("POST", "/auth/totp/login", recovery, ""); res.Code != 200 {
+		t.Error("User should login with a recovery code. Got: ", res.Code, res.Body.String())
+	}
+	recovery = `{"challenge": "` + login() + `", "code": "` + codes.RecoveryCodes[0] + `"}`
+	if res = serve("POST", "/auth/totp/login", recovery, ""); res.Code != 401 {
+		t.Error("Recovery code should not be used twice. Got: ", res.Code)
+	}
+
+	if res = serve("POST", "/auth/totp/disable", `{"code": "`+codes.RecoveryCodes[0]+`"}`, cookie); res.Code != 400 {
+		t.Error("Used recovery code should not disable TOTP. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/totp/disable", `{"code": "`+codes.RecoveryCodes[1]+`"}`, cookie); res.Code != 200 {
+		t.Fatal("TOTP should be disabled. Got: ", res.Code, res.Body.String())
+	}
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 200 {
+		t.Error("User should login without second factor. Got: ", res.Code)
+	}
+}
+
+func TestTOTPDisableLockout(t *testing.T) {
+	ng, serve := setupAccounts(t, WithLoginLimits(LoginLimits{Attempts: 3, Lockout: time.Minute}))
+	defer ng.Close()
+
+	res := serve("POST", "/auth/register", `{"email": "adphi@example.com", "secret": "something-secret"}`, "")
+	cookie := res.Header().Get("Set-Cookie")
+
+	res = serve("POST", "/auth/totp/enroll", "", cookie)
+	var enrollment totpEnrollment
+	json.Unmarshal(res.Body.Bytes(), &enrollment)
+	secret, _ := totpEncoding.DecodeString(enrollment.Secret)
+	step := totpStep(time.Now())
+	if res = serve("POST", "/auth/totp/verify", `{"code": "`+totpCode(secret, step)+`"}`, cookie); res.Code != 200 {
+		t.Fatal("TOTP should be enabled. Got: ", res.Code, res.Body.String())
+	}
+
+	// A stolen session cannot guess the code
+	for i := 0; i < 3; i++ {
+		if res = serve("POST", "/auth/totp/disable", `{"code": "000000x"}`, cookie); res.Code != 400 {
+			t.Fatal("Wrong code should be rejected. Got: ", res.Code)
+		}
+	}
+	res = serve("POST", "/auth/totp/disable", `{"code": "`+totpCode(secret, step+1)+`"}`, cookie)
+	if res.Code != 429 || res.Header().Get("Retry-After") == "" {
+		t.Error("TOTP disable should be locked out. Got: ", res.Code, res.Header())
+	}
+}
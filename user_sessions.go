@@ -0,0 +1,317 @@
+// user_sessions stores the logins of users server side, so they can
+// be listed and revoked. Each login has a long-lived refresh token
+// exchanged for new access tokens:
+// POST /auth/refresh {"refresh_token": "..."}
+// GET /auth/sessions
+// DELETE /auth/sessions/{id}
+// DELETE /auth/sessions
+
+package goal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// RefreshTokenHeader is the response header containing the refresh
+// token of the user after register and login
+const RefreshTokenHeader = "X-Refresh-Token"
+
+// sessionIDKey is the session cookie key of the server side session id
+const sessionIDKey = "goal.SessionID"
+
+// defaultRefreshExpiry is the default lifetime of refresh tokens,
+// extended every time they are used
+const defaultRefreshExpiry = 30 * 24 * time.Hour
+
+// UserSession is a login of an user, stored server side
+type UserSession struct {
+	ID         string     `gorm:"primary_key" json:"id"`
+	UserID     string     `gorm:"index" json:"-"`
+	TokenHash  string     `gorm:"unique_index" json:"-"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	// Current is true for the session of the request
+	Current bool `gorm:"-" json:"current"`
+}
+
+func (UserSession) TableName() string {
+	return "goal_sessions"
+}
+
+// tokenResponse is returned when a refresh token is used
+type tokenResponse struct {
+	AccessToken  string    `json:"access_token,omitempty"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionRevoked      = errors.New("session is revoked or expired")
+	ErrUnknownSession      = errors.New("unknown session")
+)
+
+// randomToken returns a random url safe token
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash stored in database instead of the token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestIP returns the address of the client without port
+func requestIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the address of the client, as set by WithClientIP
+func (g *Goal) clientIP(req *http.Request) string {
+	if g.c.clientIP != nil {
+		return g.c.clientIP(req)
+	}
+	return requestIP(req)
+}
+
+// refreshExpiry returns the lifetime of refresh tokens
+func (g *Goal) refreshExpiry() time.Duration {
+	if g.c.refreshExpiry > 0 {
+		return g.c.refreshExpiry
+	}
+	return defaultRefreshExpiry
+}
+
+// startSession stores a new session for the user and returns its refresh token
+func (g *Goal) startSession(req *http.Request, user interface{}) (*UserSession, string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &UserSession{
+		ID:         id,
+		UserID:     fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue()),
+		TokenHash:  hashToken(token),
+		UserAgent:  req.UserAgent(),
+		IP:         g.clientIP(req),
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(g.refreshExpiry()),
+	}
+	if err = g.db.Create(session).Error; err != nil {
+		return nil, "", err
+	}
+	return session, token, nil
+}
+
+// activeSession returns the session if it is neither revoked nor expired
+func (g *Goal) activeSession(id string) (*UserSession, error) {
+	session := &UserSession{}
+	err := g.db.Where("id = ?", id).First(session).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionRevoked
+	}
+	return session, nil
+}
+
+// currentSession returns the server side session of the request, from
+// the bearer token if there is one, or from the session cookie
+func (g *Goal) currentSession(req *http.Request) (*UserSession, error) {
+	if token := bearerToken(req); token != "" && g.jwt != nil {
+		claims, err := g.jwt.verify(token)
+		if err != nil {
+			return nil, err
+		}
+		session, err := g.activeSession(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if session.UserID != claims.Subject {
+			return nil, ErrInvalidToken
+		}
+		return session, nil
+	}
+
+	cookie, err := g.session.Get(req, g.c.sessionName)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := cookie.Values[sessionIDKey].(string)
+	if !ok {
+		return nil, errors.New("empty session")
+	}
+	return g.activeSession(id)
+}
+
+// RevokeSession revokes a session, its refresh token and access tokens
+// are no longer accepted
+func (g *Goal) RevokeSession(id string) error {
+	return g.db.Model(&UserSession{}).Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeUserSessions revokes all the sessions of the user
+func (g *Goal) RevokeUserSessions(user interface{}) error {
+	userID := fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue())
+	return g.db.Model(&UserSession{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// UserSessions returns the active sessions of the user
+func (g *Goal) UserSessions(user interface{}) ([]UserSession, error) {
+	return g.activeSessions(fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue()))
+}
+
+// activeSessions returns the active sessions of the user id, the most
+// recently used first
+func (g *Goal) activeSessions(userID string) ([]UserSession, error) {
+	sessions := []UserSession{}
+	err := g.db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+// refreshHandler exchanges a refresh token for a new access token and
+// a new refresh token, the previous one cannot be used again
+func (g *Goal) refreshHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	if request.Method != http.MethodPost {
+		return 405, nil, http.ErrNotSupported
+	}
+
+	var values map[string]string
+	if err := json.NewDecoder(request.Body).Decode(&values); err != nil {
+		return 400, nil, err
+	}
+	token := values["refresh_token"]
+	if token == "" {
+		return 401, nil, ErrInvalidRefreshToken
+	}
+
+	session := &UserSession{}
+	err := g.db.Where("token_hash = ?", hashToken(token)).First(session).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 401, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return 500, nil, err
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return 401, nil, ErrSessionRevoked
+	}
+
+	// Rotate the refresh token, the update fails if it was used meanwhile
+	next, err := randomToken()
+	if err != nil {
+		return 500, nil, err
+	}
+	now := time.Now()
+	result := g.db.Model(&UserSession{}).
+		Where("id = ? AND token_hash = ?", session.ID, session.TokenHash).
+		Updates(map[string]interface{}{
+			"token_hash":   hashToken(next),
+			"last_used_at": now,
+			"expires_at":   now.Add(g.refreshExpiry()),
+		})
+	if result.Error != nil {
+		return 500, nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 401, nil, ErrInvalidRefreshToken
+	}
+
+	response := &tokenResponse{RefreshToken: next}
+	if g.jwt != nil {
+		response.AccessToken, response.ExpiresAt, err = g.jwt.issue(session.UserID, session.ID)
+		if err != nil {
+			return 500, nil, err
+		}
+		rw.Header().Set(AccessTokenHeader, response.AccessToken)
+	}
+	rw.Header().Set(RefreshTokenHeader, next)
+	return 200, response, nil
+}
+
+// sessionsHandler lists the active sessions of current user, and revokes
+// one or all of them
+func (g *Goal) sessionsHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	current, err := g.currentSession(request)
+	if err != nil {
+		return 401, nil, err
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		sessions, err := g.activeSessions(current.UserID)
+		if err != nil {
+			return 500, nil, err
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current.ID
+		}
+		return 200, sessions, nil
+	case http.MethodDelete:
+		query := g.db.Model(&UserSession{}).Where("user_id = ? AND revoked_at IS NULL", current.UserID)
+		if id, ok := mux.Vars(request)["id"]; ok {
+			query = query.Where("id = ?", id)
+		}
+		result := query.Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return 500, nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return 404, nil, ErrUnknownSession
+		}
+		return 200, nil, nil
+	default:
+		return 405, nil, http.ErrNotSupported
+	}
+}
+
+// AddSessionPaths lets users refresh their tokens, list and revoke
+// their sessions
+func (g *Goal) AddSessionPaths() {
+	g.mux.HandleFunc("/auth/refresh", func(rw http.ResponseWriter, request *http.Request) {
+		g.renderJSON(rw, request, g.refreshHandler)
+	})
+	sessions := func(rw http.ResponseWriter, request *http.Request) {
+		g.renderJSON(rw, request, g.sessionsHandler)
+	}
+	g.mux.HandleFunc("/auth/sessions", sessions)
+	g.mux.HandleFunc("/auth/sessions/{id}", sessions)
+}
@@ -0,0 +1,405 @@
+// verification sends tokens by email to verify the address of users
+// and to reset forgotten passwords:
+// POST /auth/verify/send {"email": "..."}
+// POST /auth/verify {"token": "..."}
+// POST /auth/password/forgot {"email": "..."}
+// POST /auth/password/reset {"token": "...", "password": "..."}
+
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// verifyTokenExpiry is the lifetime of email verification tokens
+	verifyTokenExpiry = 48 * time.Hour
+	// resetTokenExpiry is the lifetime of password reset tokens
+	resetTokenExpiry = time.Hour
+)
+
+// tokenPurpose is the flow an auth token belongs to
+type tokenPurpose string
+
+const (
+	purposeVerify tokenPurpose = "verify"
+	purposeReset  tokenPurpose = "reset"
+)
+
+// authToken is a token sent by email, only its hash is stored
+type authToken struct {
+	Hash      string `gorm:"primary_key"`
+	UserID    string `gorm:"index"`
+	Purpose   string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func (authToken) TableName() string {
+	return "goal_auth_tokens"
+}
+
+// emailVerification records the verified email of an user
+type emailVerification struct {
+	UserID     string `gorm:"primary_key"`
+	Email      string
+	VerifiedAt time.Time
+}
+
+func (emailVerification) TableName() string {
+	return "goal_email_verifications"
+}
+
+var (
+	ErrNilMailer          = errors.New("mailer cannot be nil")
+	ErrMailerRequired     = errors.New("email verification requires a mailer")
+	ErrEmailNotVerified   = errors.New("email is not verified")
+	ErrInvalidAuthToken   = errors.New("invalid or expired token")
+	ErrEmptyEmail         = errors.New("email is not found")
+	ErrEmptyPassword      = errors.New("password is not found")
+	ErrUnknownEmailColumn = errors.New("email column does not exist")
+)
+
+// WithMailer sends verification and password reset emails with mailer
+func WithMailer(mailer Mailer) Option {
+	return func(goal *Goal) error {
+		if mailer == nil {
+			return ErrNilMailer
+		}
+		goal.mailer = mailer
+		return nil
+	}
+}
+
+// WithEmailVerification blocks login until users verified their email.
+// A mailer must be set with WithMailer to send the verification tokens
+func WithEmailVerification() Option {
+	return func(goal *Goal) error {
+		goal.c.requireVerification = true
+		return nil
+	}
+}
+
+// EmailColumn sets the column of the email, the username
+// column by default
+func EmailColumn(column string) UserOption {
+	return func(g *Goal) {
+		g.c.emailColumn = column
+	}
+}
+
+// emailColumn returns the column of the user email
+func (g *Goal) emailColumn() string {
+	if g.c.emailColumn != "" {
+		return g.c.emailColumn
+	}
+	return g.c.usernameColumn
+}
+
+// userEmail returns the email of the user
+func (g *Goal) userEmail(user interface{}) (string, error) {
+	field, ok := g.db.NewScope(user).FieldByName(g.emailColumn())
+	if !ok {
+		return "", ErrUnknownEmailColumn
+	}
+	return fmt.Sprint(field.Field.Interface()), nil
+}
+
+// userByEmail returns the user with the email, or nil
+func (g *Goal) userByEmail(email string) (interface{}, error) {
+	user, err := g.getUserResource()
+	if err != nil {
+		return nil, err
+	}
+
+	scope := g.db.NewScope(user)
+	field, ok := scope.FieldByName(g.emailColumn())
+	if !ok {
+		return nil, ErrUnknownEmailColumn
+	}
+
+	err = g.db.Where(fmt.Sprintf("%s = ?", scope.Quote(field.DBName)), email).First(user).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// userByID returns the user with the primary key
+func (g *Goal) userByID(id string) (interface{}, error) {
+	user, err := g.getUserResource()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s = ?", g.db.NewScope(user).PrimaryKey())
+	return user, g.db.Where(key, id).First(user).Error
+}
+
+// IsEmailVerified reports whether the user verified its current email
+func (g *Goal) IsEmailVerified(user interface{}) (bool, error) {
+	email, err := g.userEmail(user)
+	if err != nil {
+		return false, err
+	}
+
+	userID := fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue())
+	var count int
+	err = g.db.Model(&emailVerification{}).Where("user_id = ? AND email = ?", userID, email).Count(&count).Error
+	return count > 0, err
+}
+
+// markEmailVerified records the current email of the user as verified
+func (g *Goal) markEmailVerified(user interface{}) error {
+	email, err := g.userEmail(user)
+	if err != nil {
+		return err
+	}
+
+	userID := fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue())
+	return g.db.Save(&emailVerification{UserID: userID, Email: email, VerifiedAt: time.Now()}).Error
+}
+
+// issueAuthToken stores a new token for the user and returns it
+func (g *Goal) issueAuthToken(user interface{}, purpose tokenPurpose, expiry time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	record := &authToken{
+		Hash:      hashToken(token),
+		UserID:    fmt.Sprint(g.db.NewScope(user).PrimaryKeyValue()),
+		Purpose:   string(purpose),
+		ExpiresAt: time.Now().Add(expiry),
+	}
+	return token, g.db.Create(record).Error
+}
+
+// findAuthToken returns the record and the user of a valid token
+func (g *Goal) findAuthToken(token string, purpose tokenPurpose) (*authToken, interface{}, error) {
+	record := &authToken{}
+	err := g.db.Where("hash = ? AND purpose = ?", hashToken(token), string(purpose)).First(record).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil, ErrInvalidAuthToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.UsedAt != nil || time.Now().After(record.ExpiresAt) {
+		return nil, nil, ErrInvalidAuthToken
+	}
+
+	user, err := g.userByID(record.UserID)
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil, ErrInvalidAuthToken
+	}
+	return record, user, err
+}
+
+// consumeAuthToken marks the token as used, it fails if the token
+// was used meanwhile
+func (g *Goal) consumeAuthToken(record *authToken) error {
+	result := g.db.Model(&authToken{}).Where("hash = ? AND used_at IS NULL", record.Hash).Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidAuthToken
+	}
+	return nil
+}
+
+// useAuthToken marks the token as used and returns its user. A token
+// can only be used once
+func (g *Goal) useAuthToken(token string, purpose tokenPurpose) (interface{}, error) {
+	record, user, err := g.findAuthToken(token, purpose)
+	if err != nil {
+		return nil, err
+	}
+	if err = g.consumeAuthToken(record); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SendVerificationEmail sends a token to the user to verify its email
+func (g *Goal) SendVerificationEmail(user interface{}) error {
+	if g.mailer == nil {
+		return ErrNilMailer
+	}
+	email, err := g.userEmail(user)
+	if err != nil {
+		return err
+	}
+
+	token, err := g.issueAuthToken(user, purposeVerify, verifyTokenExpiry)
+	if err != nil {
+		return err
+	}
+	return g.mailer.Send(&Mail{
+		To:      email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Your verification token is: %s", token),
+	})
+}
+
+// SendPasswordResetEmail sends a token to the user to reset its password
+func (g *Goal) SendPasswordResetEmail(user interface{}) error {
+	if g.mailer == nil {
+		return ErrNilMailer
+	}
+	email, err := g.userEmail(user)
+	if err != nil {
+		return err
+	}
+
+	token, err := g.issueAuthToken(user, purposeReset, resetTokenExpiry)
+	if err != nil {
+		return err
+	}
+	return g.mailer.Send(&Mail{
+		To:      email,
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf("Your password reset token is: %s", token),
+	})
+}
+
+// decodeValues parses the request body of the auth endpoints
+func decodeValues(request *http.Request) (map[string]string, error) {
+	if request.Method != http.MethodPost {
+		return nil, http.ErrNotSupported
+	}
+	var values map[string]string
+	err := json.NewDecoder(request.Body).Decode(&values)
+	return values, err
+}
+
+// valuesCode returns the status code of a decodeValues error
+func valuesCode(err error) int {
+	if err == http.ErrNotSupported {
+		return 405
+	}
+	return 400
+}
+
+// sendEmailHandler returns a handler sending an email to the user
+// of the address. It succeeds even if there is no such user, so that
+// addresses cannot be discovered
+func (g *Goal) sendEmailHandler(send func(user interface{}) error) simpleResponse {
+	return func(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+		values, err := decodeValues(request)
+		if err != nil {
+			return valuesCode(err), nil, err
+		}
+		if values["email"] == "" {
+			return 400, nil, ErrEmptyEmail
+		}
+
+		user, err := g.userByEmail(values["email"])
+		if err != nil {
+			return 500, nil, err
+		}
+		if user != nil {
+			if err = send(user); err != nil {
+				logrus.Errorf("Unable to send email: %v", err)
+			}
+		}
+		return 200, nil, nil
+	}
+}
+
+// verifyHandler verifies the email of the user of the token
+func (g *Goal) verifyHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	values, err := decodeValues(request)
+	if err != nil {
+		return valuesCode(err), nil, err
+	}
+
+	user, err := g.useAuthToken(values["token"], purposeVerify)
+	if err == ErrInvalidAuthToken {
+		return 400, nil, err
+	}
+	if err != nil {
+		return 500, nil, err
+	}
+
+	if err = g.markEmailVerified(user); err != nil {
+		return 500, nil, err
+	}
+	return 200, user, nil
+}
+
+// resetPasswordHandler sets the password of the user of the token. All
+// the sessions of the user are revoked
+func (g *Goal) resetPasswordHandler(rw http.ResponseWriter, request *http.Request) (int, interface{}, error) {
+	values, err := decodeValues(request)
+	if err != nil {
+		return valuesCode(err), nil, err
+	}
+	password := values["password"]
+	if password == "" {
+		return 400, nil, ErrEmptyPassword
+	}
+
+	record, user, err := g.findAuthToken(values["token"], purposeReset)
+	if err == ErrInvalidAuthToken {
+		return 400, nil, err
+	}
+	if err != nil {
+		return 500, nil, err
+	}
+
+	// The token can be used again with a valid password
+	if err = g.ValidatePassword(password, g.username(user)); err != nil {
+		violations, _ := policyViolations(err)
+		return 422, violations, err
+	}
+
+	err = g.consumeAuthToken(record)
+	if err == ErrInvalidAuthToken {
+		return 400, nil, err
+	}
+	if err != nil {
+		return 500, nil, err
+	}
+
+	hashedPw, err := g.HashPassword(password)
+	if err != nil {
+		return 500, nil, err
+	}
+	if err = g.db.Model(user).Update(g.c.passwordColumn, hashedPw).Error; err != nil {
+		return 500, nil, err
+	}
+
+	// The token proves the user owns the email
+	if err = g.markEmailVerified(user); err != nil {
+		return 500, nil, err
+	}
+	if err = g.RevokeUserSessions(user); err != nil {
+		return 500, nil, err
+	}
+	return 200, nil, nil
+}
+
+// AddVerificationPaths lets users verify their email and reset their password
+func (g *Goal) AddVerificationPaths() {
+	paths := map[string]simpleResponse{
+		"/auth/verify/send":     g.sendEmailHandler(g.SendVerificationEmail),
+		"/auth/verify":          g.verifyHandler,
+		"/auth/password/forgot": g.sendEmailHandler(g.SendPasswordResetEmail),
+		"/auth/password/reset":  g.resetPasswordHandler,
+	}
+	for path, handler := range paths {
+		handler := handler
+		g.mux.HandleFunc(path, func(rw http.ResponseWriter, request *http.Request) {
+			g.renderJSON(rw, request, handler)
+		})
+	}
+}
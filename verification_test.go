@@ -0,0 +1,118 @@
+package goal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mailToken returns the token of the last mail
+func mailToken(t *testing.T, mailer *MemoryMailer) string {
+	mails := mailer.Mails()
+	if len(mails) == 0 {
+		t.Fatal("No mail was sent")
+	}
+	body := mails[len(mails)-1].Body
+	return body[strings.LastIndex(body, " ")+1:]
+}
+
+func TestEmailVerificationMailer(t *testing.T) {
+	_, err := NewGoal(WithDBAddress("sqlite3", ":memory:"), WithEmailVerification())
+	if err != ErrMailerRequired {
+		t.Error("Email verification should require a mailer. Got: ", err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	mailer := NewMemoryMailer()
+	ng, serve := setupAccounts(t, WithMailer(mailer), WithEmailVerification(), WithPasswordPolicy(RecommendedPasswordPolicy))
+	defer ng.Close()
+
+	body := `{"email": "adphi@example.com", "secret": "something-secret"}`
+	res := serve("POST", "/auth/register", body, "")
+	if res.Code != 200 || res.Header().Get("Set-Cookie") != "" {
+		t.Fatal("User should be registered without session. Got: ", res.Code, res.Header())
+	}
+	mails := mailer.Mails()
+	if len(mails) != 1 || mails[0].To != "adphi@example.com" {
+		t.Fatal("Verification email should be sent. Got: ", mails)
+	}
+	token := mailToken(t, mailer)
+
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 403 {
+		t.Error("User should not login before verification. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/verify", `{"token": "wrong"}`, ""); res.Code != 400 {
+		t.Error("Wrong token should be rejected. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/verify", `{"token": "`+token+`"}`, ""); res.Code != 200 {
+		t.Fatal("Email should be verified. Got: ", res.Code, res.Body.String())
+	}
+	if res = serve("POST", "/auth/verify", `{"token": "`+token+`"}`, ""); res.Code != 400 {
+		t.Error("Token should not be used twice. Got: ", res.Code)
+	}
+
+	res = serve("POST", "/auth/login", body, "")
+	cookie := res.Header().Get("Set-Cookie")
+	if res.Code != 200 || cookie == "" {
+		t.Fatal("Verified user should login. Got: ", res.Code)
+	}
+
+	// Unknown addresses are not disclosed
+	if res = serve("POST", "/auth/password/forgot", `{"email": "nobody@example.com"}`, ""); res.Code != 200 {
+		t.Error("Unknown email should not be disclosed. Got: ", res.Code)
+	}
+	if len(mailer.Mails()) != 1 {
+		t.Error("No mail should be sent to unknown email. Got: ", mailer.Mails())
+	}
+
+	serve("POST", "/auth/password/forgot", `{"email": "adphi@example.com"}`, "")
+	token = mailToken(t, mailer)
+	weak := `{"token": "` + token + `", "password": "password"}`
+	if res = serve("POST", "/auth/password/reset", weak, ""); res.Code != 422 {
+		t.Error("Weak password should be rejected. Got: ", res.Code)
+	}
+	reset := `{"token": "` + token + `", "password": "new-secret"}`
+	if res = serve("POST", "/auth/password/reset", reset, ""); res.Code != 200 {
+		t.Fatal("Password should be reset. Got: ", res.Code, res.Body.String())
+	}
+	if res = serve("POST", "/auth/password/reset", reset, ""); res.Code != 400 {
+		t.Error("Reset token should not be used twice. Got: ", res.Code)
+	}
+
+	if res = serve("GET", "/auth/me", "", cookie); res.Code != 401 {
+		t.Error("Sessions should be revoked after reset. Got: ", res.Code)
+	}
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 401 {
+		t.Error("Previous password should be rejected. Got: ", res.Code)
+	}
+	body = `{"email": "adphi@example.com", "secret": "new-secret"}`
+	if res = serve("POST", "/auth/login", body, ""); res.Code != 200 {
+		t.Error("New password should be accepted. Got: ", res.Code)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goal-mails")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer, err := NewFileMailer(filepath.Join(dir, "mails"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mailer.Send(&Mail{To: "adphi@example.com", Subject: "Hello", Body: "World"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "mails"))
+	if len(files) != 1 {
+		t.Fatal("Mail should be written. Got: ", files)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "mails", files[0].Name()))
+	if !strings.Contains(string(content), "Subject: Hello") || !strings.Contains(string(content), "World") {
+		t.Error("Mail should be written. Got: ", string(content))
+	}
+}